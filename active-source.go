@@ -1,7 +1,7 @@
 package main
 
 import (
-	"github.com/RobertMe/gocec"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"time"
 )
@@ -15,8 +15,9 @@ type ActiveSourceBridge struct {
 	mqtt           *Mqtt
 	activeSource   *Device
 	devices        *DeviceRegistry
+	state          *DeviceStateStore
 	monitor        *Monitor
-	allowedSources map[gocec.LogicalAddress]bool
+	allowedSources map[LogicalAddress]bool
 	haBridge       *HomeAssistantBridge
 }
 
@@ -24,13 +25,15 @@ func InitAcitveSourceBridge(container *Container) {
 	cec := container.Get("cec").(*Cec)
 	mqtt := container.Get("mqtt").(*Mqtt)
 	devices := container.Get("devices").(*DeviceRegistry)
+	state := container.Get("state").(*DeviceStateStore)
 
 	bridge := &ActiveSourceBridge{
 		cec:            cec,
 		mqtt:           mqtt,
 		activeSource:   nil,
 		devices:        devices,
-		allowedSources: make(map[gocec.LogicalAddress]bool),
+		state:          state,
+		allowedSources: make(map[LogicalAddress]bool),
 	}
 
 	bridge.monitor = CreateMonitor(
@@ -42,9 +45,38 @@ func InitAcitveSourceBridge(container *Container) {
 	)
 
 	devices.RegisterDeviceAddedHandler(func(device *Device) {
+		device.AddFeature("is_active_source")
 		bridge.allowedSources[device.LogicalAddress] = true
 	})
 
+	devices.RegisterDeviceRemovedHandler(func(device *Device) {
+		if bridge.activeSource != device {
+			return
+		}
+
+		// The monitor finds the active source again, when the device has been renamed
+		bridge.activeSource = nil
+		bridge.monitor.Reset()
+	})
+
+	state.RegisterCommandHandler("is_active_source", func(command *DeviceCommand) (interface{}, error) {
+		device := command.Device
+		active, ok := parseOnOff(command.Value)
+		if !ok || !active {
+			log.WithFields(log.Fields{
+				"device.id": device.Id,
+				"value":     command.Value,
+			}).Warn("Received invalid active source command")
+			return nil, fmt.Errorf("Invalid active source %v, a device can only be made the active source", command.Value)
+		}
+
+		log.WithFields(log.Fields{
+			"device.id": device.Id,
+		}).Info("Switching to input of device as requested")
+		cec.SetStreamPath(device.CecDevice.physicalAddress)
+		return true, nil
+	}, OpcodeSetStreamPath)
+
 	if haBridge, ok := container.Get("home-assistant").(*HomeAssistantBridge); ok {
 		log.Info("Enabling Home Assistant configuration for active source")
 		bridge.haBridge = haBridge
@@ -54,7 +86,7 @@ func InitAcitveSourceBridge(container *Container) {
 		haBridge.RegisterBirthHandler(bridge.resendAll)
 	}
 
-	cec.RegisterMessageHandler(func(message gocec.Message) {
+	cec.RegisterMessageHandler(func(message Message) {
 		log.WithFields(log.Fields{
 			"message.source":      message.Source(),
 			"message.destination": message.Destination(),
@@ -63,9 +95,9 @@ func InitAcitveSourceBridge(container *Container) {
 		}).Debug("Restarting active source monitor")
 
 		bridge.monitor.Reset()
-	}, gocec.OpcodeActiveSource, gocec.OpcodeSetStreamPath)
+	}, OpcodeActiveSource, OpcodeSetStreamPath)
 
-	cec.RegisterMessageHandler(func(message gocec.Message) {
+	cec.RegisterMessageHandler(func(message Message) {
 		log.WithFields(log.Fields{
 			"message.source":      message.Source(),
 			"message.destination": message.Destination(),
@@ -75,24 +107,30 @@ func InitAcitveSourceBridge(container *Container) {
 
 		defer bridge.monitor.Reset()
 
-		powerStatus := gocec.PowerStatus(message.Parameters()[0])
-		bridge.allowedSources[message.Source()] = powerStatus != gocec.PowerStatusStandBy
+		powerStatus := PowerStatus(message.Parameters()[0])
+		bridge.allowedSources[message.Source()] = powerStatus != PowerStatusStandBy
 
 		if bridge.activeSource == nil || message.Source() != bridge.activeSource.LogicalAddress {
 			return
 		}
 
-		if powerStatus == gocec.PowerStatusStandBy {
+		if powerStatus == PowerStatusStandBy {
 			bridge.updateActiveSource(nil)
 		}
-	}, gocec.OpcodeReportPowerStatus)
+	}, OpcodeReportPowerStatus)
 
-	cec.RegisterMessageHandler(func(message gocec.Message) {
-		if message.Source() == gocec.DeviceTV {
+	cec.RegisterMessageHandler(func(message Message) {
+		if message.Source() == DeviceTV {
 			log.Debug("Setting active source to nil because TV is in standby")
 			bridge.updateActiveSource(nil)
 		}
-	}, gocec.OpcodeStandby)
+	}, OpcodeStandby)
+
+	cec.RegisterReconnectedHandler(func() {
+		log.Debug("Restarting active source monitor because CEC connection has been restored")
+
+		bridge.monitor.Reset()
+	})
 
 	mqtt.RegisterConnectedHandler(bridge.resendAll)
 
@@ -136,13 +174,12 @@ func (bridge *ActiveSourceBridge) updateActiveSource(newSource *Device) {
 		"to":   to,
 	}).Info("Updating active source")
 
-	mqtt := bridge.mqtt
 	if bridge.activeSource != nil {
 		log.WithFields(log.Fields{
 			"device.id": bridge.activeSource.Id,
 		}).Debug("Setting device as inactive source")
 
-		mqtt.Publish(mqtt.BuildTopic(bridge.activeSource, "is_active_source"), 0, false, "off")
+		bridge.state.Set(bridge.activeSource, "is_active_source", false)
 	}
 
 	if newSource != nil {
@@ -150,18 +187,18 @@ func (bridge *ActiveSourceBridge) updateActiveSource(newSource *Device) {
 			"device.id": newSource.Id,
 		}).Debug("Setting device as active source")
 
-		mqtt.Publish(mqtt.BuildTopic(newSource, "is_active_source"), 0, false, "on")
+		bridge.state.Set(newSource, "is_active_source", true)
 	}
 
 	bridge.activeSource = newSource
 }
 
 func (bridge *ActiveSourceBridge) checkActiveSource() {
-	address := bridge.cec.connection.GetActiveSource()
+	address := bridge.cec.GetActiveSource()
 
 	var newSource *Device = nil
 	newSourceId := ""
-	if address != gocec.DeviceUnknown {
+	if address != DeviceUnknown {
 		if newSource = bridge.devices.FindByLogicalAddress(address); newSource != nil {
 			newSourceId = newSource.Id
 		}
@@ -178,16 +215,16 @@ func (bridge *ActiveSourceBridge) checkActiveSource() {
 func (bridge *ActiveSourceBridge) resendAll() {
 	log.Debug("Resending all active source states")
 	for _, device := range bridge.devices.List() {
-		if bridge.haBridge != nil {
-			bridge.haBridge.RegisterBinarySensor(device, "is_active_source")
+		if device.Config.Ignore {
+			continue
 		}
 
-		value := "off"
-		if device.Id == bridge.activeSource.Id {
-				value = "on"
+		if bridge.haBridge != nil {
+			bridge.haBridge.RegisterBinarySensor(device, "is_active_source")
 		}
 
-		bridge.mqtt.Publish(bridge.mqtt.BuildTopic(device, "is_active_source"), 0, false, value)
+		active := bridge.activeSource != nil && device.Id == bridge.activeSource.Id
 
+		bridge.state.Set(device, "is_active_source", active)
 	}
 }
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	// Runs last, so requests are only served once everything has been initialized
+	RegisterInitializer(-120, InitApiServer)
+}
+
+// Requests are small, but the response to a rescan is only written once the CEC bus has been scanned
+const (
+	apiReadHeaderTimeout = 5 * time.Second
+	apiReadTimeout       = 10 * time.Second
+	apiWriteTimeout      = 30 * time.Second
+	apiIdleTimeout       = time.Minute
+)
+
+//go:embed openapi.yaml
+var apiDescription []byte
+
+// The commands which can be sent to a device, with the property handling them
+var apiCommands = map[string]string{
+	"power": "power",
+	"input": "is_active_source",
+	"key":   "key",
+}
+
+// ApiServer serves an HTTP API to list the devices and their states, and to
+// send commands to them, for clients which don't speak MQTT.
+type ApiServer struct {
+	cec     *Cec
+	mqtt    *Mqtt
+	devices *DeviceRegistry
+	state   *DeviceStateStore
+	token   string
+}
+
+type apiDevicePayload struct {
+	*bridgeDevicePayload
+	States map[string]interface{} `json:"states"`
+}
+
+type apiCommandPayload struct {
+	Value interface{} `json:"value"`
+}
+
+type apiErrorPayload struct {
+	Error string `json:"error"`
+}
+
+func InitApiServer(container *Container) {
+	config := container.Get("config").(*Config)
+	if !config.Api.Enable {
+		log.Info("API is not enabled, skipping")
+		return
+	}
+
+	server := &ApiServer{
+		cec:     container.Get("cec").(*Cec),
+		mqtt:    container.Get("mqtt").(*Mqtt),
+		devices: container.Get("devices").(*DeviceRegistry),
+		state:   container.Get("state").(*DeviceStateStore),
+		token:   config.Api.Token,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/openapi.yaml", server.handleDescription)
+	mux.HandleFunc("/api/devices", server.authorize(server.handleDevices))
+	mux.HandleFunc("/api/devices/", server.authorize(server.handleDevice))
+	mux.HandleFunc("/api/bridge/rescan", server.authorize(server.handleRescan))
+
+	httpServer := &http.Server{
+		Addr:              config.Api.Address,
+		Handler:           mux,
+		ReadHeaderTimeout: apiReadHeaderTimeout,
+		ReadTimeout:       apiReadTimeout,
+		WriteTimeout:      apiWriteTimeout,
+		IdleTimeout:       apiIdleTimeout,
+	}
+
+	if config.Api.Token == "" && !isLoopbackAddress(config.Api.Address) {
+		log.WithFields(log.Fields{
+			"address": config.Api.Address,
+		}).Warn("API is reachable from the network without a token, anyone on the network can control the devices")
+	}
+
+	go func() {
+		log.WithFields(log.Fields{
+			"address": config.Api.Address,
+		}).Info("Starting API server")
+
+		if err := httpServer.ListenAndServe(); err != nil {
+			log.WithFields(log.Fields{
+				"address": config.Api.Address,
+				"error":   err,
+			}).Error("API server stopped")
+		}
+	}()
+
+	container.Register("api", server)
+}
+
+// isLoopbackAddress checks whether the address only listens on the local machine
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authorize checks the bearer token, when one has been configured
+func (server *ApiServer) authorize(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if server.token != "" {
+			token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(server.token)) != 1 {
+				server.respondError(writer, http.StatusUnauthorized, errors.New("Invalid or missing token"))
+				return
+			}
+		}
+
+		handler(writer, request)
+	}
+}
+
+func (server *ApiServer) handleDescription(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		server.respondError(writer, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/yaml")
+	_, _ = writer.Write(apiDescription)
+}
+
+func (server *ApiServer) handleDevices(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		server.respondError(writer, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+		return
+	}
+
+	server.respond(writer, http.StatusOK, server.listDevices())
+}
+
+// handleDevice handles /api/devices/<device> and /api/devices/<device>/<command>,
+// where the device is either its id or MQTT topic
+func (server *ApiServer) handleDevice(writer http.ResponseWriter, request *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(request.URL.Path, "/api/devices/"), "/")
+
+	identifier, command := path, ""
+	if index := strings.LastIndex(path, "/"); index >= 0 {
+		identifier, command = path[:index], path[index+1:]
+	}
+
+	_, device := server.devices.Find(identifier)
+	if device == nil || device.Config.Ignore {
+		server.respondError(writer, http.StatusNotFound, errors.New("Device not found or not active"))
+		return
+	}
+
+	if command == "" {
+		if request.Method != http.MethodGet {
+			server.respondError(writer, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+			return
+		}
+
+		server.respond(writer, http.StatusOK, server.createDevicePayload(device))
+		return
+	}
+
+	property, ok := apiCommands[command]
+	if !ok {
+		server.respondError(writer, http.StatusNotFound, errors.New("Unknown command "+command))
+		return
+	}
+
+	if request.Method != http.MethodPost {
+		server.respondError(writer, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+		return
+	}
+
+	server.handleCommand(writer, request, device, property)
+}
+
+func (server *ApiServer) handleCommand(writer http.ResponseWriter, request *http.Request, device *Device, property string) {
+	var payload apiCommandPayload
+	if err := json.NewDecoder(request.Body).Decode(&payload); err != nil && err != io.EOF {
+		server.respondError(writer, http.StatusBadRequest, errors.New("Invalid JSON body"))
+		return
+	}
+
+	// Switching the input doesn't need a value, the device can only be made the active source
+	if property == "is_active_source" && payload.Value == nil {
+		payload.Value = true
+	}
+
+	log.WithFields(log.Fields{
+		"device.id": device.Id,
+		"property":  property,
+		"value":     payload.Value,
+	}).Debug("Received command on API")
+
+	command := &DeviceCommand{
+		Device:   device,
+		Property: property,
+		Value:    payload.Value,
+		received: time.Now(),
+	}
+
+	result := &CommandResult{
+		Device:   device.Id,
+		Property: property,
+		Value:    payload.Value,
+		Status:   CommandSent,
+	}
+
+	status := http.StatusAccepted
+	if err := server.state.HandleCommand(command); err != nil {
+		result.Status = CommandInvalid
+		result.Error = err.Error()
+		status = http.StatusBadRequest
+	}
+
+	result.Latency = time.Since(command.received).Milliseconds()
+
+	server.respond(writer, status, result)
+}
+
+func (server *ApiServer) handleRescan(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		server.respondError(writer, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+		return
+	}
+
+	log.Info("Rescanning CEC bus as requested on API")
+	server.cec.Scan()
+
+	server.respond(writer, http.StatusOK, server.listDevices())
+}
+
+func (server *ApiServer) listDevices() []*apiDevicePayload {
+	payload := make([]*apiDevicePayload, 0)
+	for _, device := range server.devices.List() {
+		if device.Config.Ignore {
+			continue
+		}
+
+		payload = append(payload, server.createDevicePayload(device))
+	}
+
+	sort.Slice(payload, func(i, j int) bool {
+		return payload[i].LogicalAddress < payload[j].LogicalAddress
+	})
+
+	return payload
+}
+
+func (server *ApiServer) createDevicePayload(device *Device) *apiDevicePayload {
+	return &apiDevicePayload{
+		bridgeDevicePayload: createBridgeDevicePayload(device, server.mqtt.BuildDeviceTopic(device)),
+		States:              server.state.States(device),
+	}
+}
+
+func (server *ApiServer) respond(writer http.ResponseWriter, status int, payload interface{}) {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to convert API response to JSON")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	_, _ = writer.Write(encoded)
+}
+
+func (server *ApiServer) respondError(writer http.ResponseWriter, status int, err error) {
+	server.respond(writer, status, &apiErrorPayload{Error: err.Error()})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+func init() {
+	// Runs last, so all features of a device are known when it's added
+	RegisterInitializer(-100, InitBridgeInfo)
+}
+
+const bridgeInfoInterval = time.Minute
+
+// BridgeInfo publishes information about cec2mqtt and the devices it knows to
+// the retained info and devices topics of the bridge.
+type BridgeInfo struct {
+	cec     *Cec
+	mqtt    *Mqtt
+	devices *DeviceRegistry
+	config  *Config
+	started time.Time
+}
+
+type bridgeInfoPayload struct {
+	Version string                 `json:"version"`
+	Started time.Time              `json:"started"`
+	Uptime  int64                  `json:"uptime"`
+	Adapter bridgeAdapterPayload   `json:"adapter"`
+	Stats   bridgeStatsPayload     `json:"stats"`
+	Config  map[string]interface{} `json:"config"`
+}
+
+type bridgeStatsPayload struct {
+	MessagesReceived    int `json:"messages_received"`
+	MessagesTransmitted int `json:"messages_transmitted"`
+	Errors              int `json:"errors"`
+}
+
+type bridgeAdapterPayload struct {
+	Path           string `json:"path"`
+	Comm           string `json:"comm"`
+	LogicalAddress int    `json:"logical_address"`
+}
+
+type bridgeDevicePayload struct {
+	Id              string   `json:"id"`
+	Topic           string   `json:"topic"`
+	OSD             string   `json:"osd"`
+	VendorId        int      `json:"vendor_id"`
+	Vendor          string   `json:"vendor"`
+	PhysicalAddress string   `json:"physical_address"`
+	LogicalAddress  int      `json:"logical_address"`
+	Ignored         bool     `json:"ignored"`
+	Features        []string `json:"features"`
+}
+
+func InitBridgeInfo(container *Container) {
+	devices := container.Get("devices").(*DeviceRegistry)
+	mqtt := container.Get("mqtt").(*Mqtt)
+
+	info := &BridgeInfo{
+		cec:     container.Get("cec").(*Cec),
+		mqtt:    mqtt,
+		devices: devices,
+		config:  container.Get("config").(*Config),
+		started: time.Now(),
+	}
+
+	devices.RegisterDeviceAddedHandler(func(_ *Device) {
+		info.PublishDevices()
+	})
+	devices.RegisterDeviceRemovedHandler(func(_ *Device) {
+		info.PublishDevices()
+	})
+
+	mqtt.RegisterConnectedHandler(info.PublishInfo)
+	mqtt.RegisterConnectedHandler(info.PublishDevices)
+
+	go info.run()
+
+	container.Register("bridge-info", info)
+}
+
+func (info *BridgeInfo) run() {
+	info.PublishInfo()
+
+	// Keeps the uptime up to date
+	ticker := time.NewTicker(bridgeInfoInterval)
+
+	for range ticker.C {
+		info.PublishInfo()
+	}
+}
+
+func (info *BridgeInfo) PublishInfo() {
+	adapter, address := info.cec.Adapter()
+	received, transmitted, errors := info.cec.Stats()
+
+	payload := &bridgeInfoPayload{
+		Version: BuildVersion,
+		Started: info.started,
+		Uptime:  int64(time.Since(info.started).Seconds()),
+		Adapter: bridgeAdapterPayload{
+			Path:           adapter.Path,
+			Comm:           adapter.Comm,
+			LogicalAddress: int(address),
+		},
+		Stats: bridgeStatsPayload{
+			MessagesReceived:    received,
+			MessagesTransmitted: transmitted,
+			Errors:              errors,
+		},
+		Config: map[string]interface{}{
+			"base_topic":       info.config.Mqtt.BaseTopic,
+			"protocol_version": info.config.Mqtt.ProtocolVersion,
+			"state_format":     info.config.Mqtt.StateFormat,
+			"cec_backend":      info.config.Cec.Backend,
+			"home_assistant":   info.config.HomeAssistant.Enable,
+		},
+	}
+
+	info.publish("info", payload)
+}
+
+func (info *BridgeInfo) PublishDevices() {
+	payload := make([]*bridgeDevicePayload, 0)
+
+	for _, device := range info.devices.List() {
+		payload = append(payload, createBridgeDevicePayload(device, info.mqtt.BuildDeviceTopic(device)))
+	}
+
+	sort.Slice(payload, func(i, j int) bool {
+		return payload[i].LogicalAddress < payload[j].LogicalAddress
+	})
+
+	info.publish("devices", payload)
+}
+
+func createBridgeDevicePayload(device *Device, topic string) *bridgeDevicePayload {
+	return &bridgeDevicePayload{
+		Id:              device.Id,
+		Topic:           topic,
+		OSD:             device.CecDevice.OSD,
+		VendorId:        int(device.CecDevice.vendor),
+		Vendor:          device.CecDevice.vendor.String(),
+		PhysicalAddress: device.CecDevice.physicalAddress.String(),
+		LogicalAddress:  int(device.LogicalAddress),
+		Ignored:         device.Config.Ignore,
+		Features:        device.Features(),
+	}
+}
+
+func (info *BridgeInfo) publish(suffix string, payload interface{}) {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"topic": suffix,
+			"error": err,
+		}).Error("Failed to convert bridge information to JSON")
+		return
+	}
+
+	info.mqtt.Publish(info.mqtt.BuildBridgeTopic(suffix), 0, true, encoded)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+)
+
+func init() {
+	// Runs after the bridge info, which is published after every change
+	RegisterInitializer(-110, InitBridgeRequests)
+}
+
+// BridgeRequests handles the requests on the request topics of the bridge to
+// manage the devices and the bridge itself at runtime.
+type BridgeRequests struct {
+	mqtt    *Mqtt
+	devices *DeviceRegistry
+	info    *BridgeInfo
+
+	// Requests are handled one at a time
+	mutex sync.Mutex
+}
+
+type deviceRequestPayload struct {
+	Id        string `json:"id"`
+	Topic     string `json:"topic"`
+	RequestId string `json:"request_id"`
+}
+
+type deviceResponsePayload struct {
+	RequestId string                `json:"request_id,omitempty"`
+	Status    string                `json:"status"`
+	Error     string                `json:"error,omitempty"`
+	Data      *deviceResponseDevice `json:"data,omitempty"`
+}
+
+type deviceResponseDevice struct {
+	Id      string `json:"id"`
+	Topic   string `json:"topic"`
+	Ignored bool   `json:"ignored"`
+	Removed bool   `json:"removed,omitempty"`
+}
+
+type deviceRequestHandler func(config *DeviceConfig, device *Device, request *deviceRequestPayload) error
+
+// bridgeRequestHandler handles a request which isn't about a single device, like rescanning the bus
+type bridgeRequestHandler func() error
+
+func InitBridgeRequests(container *Container) {
+	mqtt := container.Get("mqtt").(*Mqtt)
+	devices := container.Get("devices").(*DeviceRegistry)
+
+	cec := container.Get("cec").(*Cec)
+
+	requests := &BridgeRequests{
+		mqtt:    mqtt,
+		devices: devices,
+		info:    container.Get("bridge-info").(*BridgeInfo),
+	}
+
+	handlers := map[string]deviceRequestHandler{
+		"rename": func(config *DeviceConfig, device *Device, request *deviceRequestPayload) error {
+			return devices.Rename(config, device, request.Topic)
+		},
+		"ignore": func(config *DeviceConfig, device *Device, _ *deviceRequestPayload) error {
+			return devices.Ignore(config, device)
+		},
+		"unignore": func(config *DeviceConfig, device *Device, _ *deviceRequestPayload) error {
+			return devices.Unignore(config, device)
+		},
+		"remove": func(config *DeviceConfig, device *Device, _ *deviceRequestPayload) error {
+			return devices.Remove(config, device)
+		},
+	}
+
+	for action, handler := range handlers {
+		action, handler := action, handler
+
+		mqtt.SubscribeMessage(mqtt.BuildBridgeTopic("request/device/"+action), 0, func(message *MqttMessage) {
+			// Handling a request waits for the features to update the device, which must not block the MQTT client
+			go requests.handle(action, handler, message)
+		})
+	}
+
+	bridgeHandlers := map[string]bridgeRequestHandler{
+		"cec/rescan": func() error {
+			cec.Scan()
+			return nil
+		},
+		"cec/restart": cec.Restart,
+	}
+
+	if haBridge, ok := container.Get("home-assistant").(*HomeAssistantBridge); ok {
+		bridgeHandlers["home_assistant/discovery"] = func() error {
+			haBridge.Rediscover()
+			return nil
+		}
+	}
+
+	for action, handler := range bridgeHandlers {
+		action, handler := action, handler
+
+		mqtt.SubscribeMessage(mqtt.BuildBridgeTopic("request/"+action), 0, func(message *MqttMessage) {
+			go requests.handleBridge(action, handler, message)
+		})
+	}
+
+	container.Register("bridge-requests", requests)
+}
+
+func (requests *BridgeRequests) handle(action string, handler deviceRequestHandler, message *MqttMessage) {
+	requests.mutex.Lock()
+	defer requests.mutex.Unlock()
+
+	request := &deviceRequestPayload{}
+
+	// Besides a JSON object the payload can just be the id or topic of the device
+	if err := json.Unmarshal(message.Payload, request); err != nil {
+		request.Id = strings.TrimSpace(string(message.Payload))
+	}
+	if request.RequestId == "" {
+		request.RequestId = string(message.CorrelationData)
+	}
+
+	logContext := log.WithFields(log.Fields{
+		"action":     action,
+		"device":     request.Id,
+		"request_id": request.RequestId,
+	})
+	logContext.Info("Handling device request")
+
+	response := &deviceResponsePayload{
+		RequestId: request.RequestId,
+		Status:    "ok",
+	}
+
+	err := requests.handleDevice(handler, request, response)
+	if err != nil {
+		logContext.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Failed to handle device request")
+
+		response.Status = "error"
+		response.Error = err.Error()
+	} else {
+		requests.info.PublishDevices()
+	}
+
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		logContext.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to convert device response to JSON")
+		return
+	}
+
+	requests.mqtt.Respond(message, requests.mqtt.BuildBridgeTopic("response/device/"+action), encoded)
+}
+
+func (requests *BridgeRequests) handleBridge(action string, handler bridgeRequestHandler, message *MqttMessage) {
+	requests.mutex.Lock()
+	defer requests.mutex.Unlock()
+
+	// The payload is optional, for example when the request is made by a button in Home Assistant
+	request := &deviceRequestPayload{}
+	_ = json.Unmarshal(message.Payload, request)
+	if request.RequestId == "" {
+		request.RequestId = string(message.CorrelationData)
+	}
+
+	logContext := log.WithFields(log.Fields{
+		"action":     action,
+		"request_id": request.RequestId,
+	})
+	logContext.Info("Handling bridge request")
+
+	response := &deviceResponsePayload{
+		RequestId: request.RequestId,
+		Status:    "ok",
+	}
+
+	if err := handler(); err != nil {
+		logContext.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Failed to handle bridge request")
+
+		response.Status = "error"
+		response.Error = err.Error()
+	}
+
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		logContext.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to convert bridge response to JSON")
+		return
+	}
+
+	requests.mqtt.Respond(message, requests.mqtt.BuildBridgeTopic("response/"+action), encoded)
+}
+
+func (requests *BridgeRequests) handleDevice(handler deviceRequestHandler, request *deviceRequestPayload, response *deviceResponsePayload) error {
+	if request.Id == "" {
+		return errors.New("No device given")
+	}
+
+	config, device := requests.devices.Find(request.Id)
+	if config == nil {
+		return errors.New("Unknown device " + request.Id)
+	}
+
+	if err := handler(config, device, request); err != nil {
+		return err
+	}
+
+	remaining, _ := requests.devices.Find(config.Id)
+	response.Data = &deviceResponseDevice{
+		Id:      config.Id,
+		Topic:   config.MqttTopic,
+		Ignored: config.Ignore,
+		Removed: remaining == nil,
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CecBackend is the interface to the CEC bus. It follows the API of the
+// connection of gocec, which is wrapped by the libcec backend.
+type CecBackend interface {
+	FindAdapters() []Adapter
+	Open(adapter Adapter) error
+	GetAdapterAddress() (LogicalAddress, error)
+	ActiveDevices() []LogicalAddress
+	GetPowerStatus(address LogicalAddress) PowerStatus
+	GetPhysicalAddress(address LogicalAddress) PhysicalAddress
+	GetVendor(address LogicalAddress) Vendor
+	GetOSDName(address LogicalAddress) string
+	PowerOnDevice(address LogicalAddress)
+	StandByDevice(address LogicalAddress)
+	GetActiveSource() LogicalAddress
+	Transmit(message Message)
+}
+
+// CecBackendCloser is implemented by backends which hold the adapter or run in
+// the background, so these can be stopped when the backend is replaced.
+type CecBackendCloser interface {
+	Close()
+}
+
+// CecBackendFactory creates a backend which reports all traffic, in the same
+// format as libcec, to the log callback.
+type CecBackendFactory func(config *Config, logCallback LogCallback) (CecBackend, error)
+
+var cecBackends = make(map[string]CecBackendFactory)
+
+func RegisterCecBackend(name string, factory CecBackendFactory) {
+	cecBackends[name] = factory
+}
+
+// formatFrame formats a message the same way libcec does in its traffic log.
+func formatFrame(message Message) string {
+	parts := make([]string, len(message))
+	for i, b := range message {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+
+	return strings.Join(parts, ":")
+}
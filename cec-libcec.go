@@ -0,0 +1,213 @@
+//go:build !nolibcec
+// +build !nolibcec
+
+package main
+
+// #cgo pkg-config: libcec
+// #include <libcec/cecc.h>
+import "C"
+
+import (
+	"errors"
+	"github.com/RobertMe/gocec"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+func init() {
+	RegisterCecBackend("libcec", NewLibCecBackend)
+}
+
+var errClosed = errors.New("libcec connection has been closed")
+
+// LibCecBackend uses libcec, through gocec, to access a real CEC adapter. It
+// converts between the types of gocec and those used by cec2mqtt.
+type LibCecBackend struct {
+	connection *gocec.Connection
+
+	// The mutex guards the connection against being used while it's closed
+	mutex  sync.RWMutex
+	closed int32
+}
+
+func NewLibCecBackend(_ *Config, logCallback LogCallback) (CecBackend, error) {
+	backend := &LibCecBackend{}
+	configuration := gocec.NewConfiguration("cec2mqtt", false)
+
+	configuration.SetMonitorOnly(false)
+	configuration.SetActivateSource(false)
+	configuration.SetLogCallback(func(message *gocec.LogMessage) {
+		// libcec may still log while it's being closed, those messages are dropped
+		if atomic.LoadInt32(&backend.closed) == 1 {
+			return
+		}
+
+		logCallback(&LogMessage{
+			Message: message.Message,
+			Level:   LogLevel(message.Level),
+			Time:    message.Time,
+		})
+	})
+
+	connection, err := gocec.NewConnection(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	backend.connection = connection
+
+	return backend, nil
+}
+
+// Close closes the adapter and releases libcec, after which the backend does
+// nothing. gocec doesn't support this, so its handle is used directly.
+func (backend *LibCecBackend) Close() {
+	if !atomic.CompareAndSwapInt32(&backend.closed, 0, 1) {
+		return
+	}
+
+	// Once the calls in progress are done nothing uses the connection anymore. The lock isn't held while
+	// closing, as libcec waits for its callbacks, which may still call the backend, to return
+	backend.mutex.Lock()
+	backend.mutex.Unlock()
+
+	handle := *(*C.libcec_connection_t)(unsafe.Pointer(backend.connection))
+	C.libcec_close(handle)
+	C.libcec_destroy(handle)
+}
+
+// lock read locks the connection and returns whether it can still be used
+func (backend *LibCecBackend) lock() bool {
+	backend.mutex.RLock()
+	if atomic.LoadInt32(&backend.closed) == 1 {
+		backend.mutex.RUnlock()
+		return false
+	}
+
+	return true
+}
+
+func (backend *LibCecBackend) FindAdapters() []Adapter {
+	if !backend.lock() {
+		return nil
+	}
+	defer backend.mutex.RUnlock()
+
+	found := backend.connection.FindAdapters()
+
+	adapters := make([]Adapter, 0, len(found))
+	for _, adapter := range found {
+		adapters = append(adapters, Adapter{Path: adapter.Path, Comm: adapter.Comm})
+	}
+
+	return adapters
+}
+
+func (backend *LibCecBackend) Open(adapter Adapter) error {
+	if !backend.lock() {
+		return errClosed
+	}
+	defer backend.mutex.RUnlock()
+
+	return backend.connection.Open(gocec.Adapter{Path: adapter.Path, Comm: adapter.Comm})
+}
+
+func (backend *LibCecBackend) GetAdapterAddress() (LogicalAddress, error) {
+	if !backend.lock() {
+		return DeviceUnknown, errClosed
+	}
+	defer backend.mutex.RUnlock()
+
+	address, err := backend.connection.GetAdapterAddress()
+
+	return LogicalAddress(address), err
+}
+
+func (backend *LibCecBackend) ActiveDevices() []LogicalAddress {
+	if !backend.lock() {
+		return nil
+	}
+	defer backend.mutex.RUnlock()
+
+	found := backend.connection.ActiveDevices()
+
+	addresses := make([]LogicalAddress, 0, len(found))
+	for _, address := range found {
+		addresses = append(addresses, LogicalAddress(address))
+	}
+
+	return addresses
+}
+
+func (backend *LibCecBackend) GetPowerStatus(address LogicalAddress) PowerStatus {
+	if !backend.lock() {
+		return PowerStatusUnknown
+	}
+	defer backend.mutex.RUnlock()
+
+	return PowerStatus(backend.connection.GetPowerStatus(gocec.LogicalAddress(address)))
+}
+
+func (backend *LibCecBackend) GetPhysicalAddress(address LogicalAddress) PhysicalAddress {
+	if !backend.lock() {
+		return PhysicalAddress{0xFF, 0xFF}
+	}
+	defer backend.mutex.RUnlock()
+
+	return PhysicalAddress(backend.connection.GetPhysicalAddress(gocec.LogicalAddress(address)))
+}
+
+func (backend *LibCecBackend) GetVendor(address LogicalAddress) Vendor {
+	if !backend.lock() {
+		return VendorUnknown
+	}
+	defer backend.mutex.RUnlock()
+
+	return Vendor(backend.connection.GetVendor(gocec.LogicalAddress(address)))
+}
+
+func (backend *LibCecBackend) GetOSDName(address LogicalAddress) string {
+	if !backend.lock() {
+		return ""
+	}
+	defer backend.mutex.RUnlock()
+
+	return backend.connection.GetOSDName(gocec.LogicalAddress(address))
+}
+
+func (backend *LibCecBackend) PowerOnDevice(address LogicalAddress) {
+	if !backend.lock() {
+		return
+	}
+	defer backend.mutex.RUnlock()
+
+	backend.connection.PowerOnDevice(gocec.LogicalAddress(address))
+}
+
+func (backend *LibCecBackend) StandByDevice(address LogicalAddress) {
+	if !backend.lock() {
+		return
+	}
+	defer backend.mutex.RUnlock()
+
+	backend.connection.StandByDevice(gocec.LogicalAddress(address))
+}
+
+func (backend *LibCecBackend) GetActiveSource() LogicalAddress {
+	if !backend.lock() {
+		return DeviceUnknown
+	}
+	defer backend.mutex.RUnlock()
+
+	return LogicalAddress(backend.connection.GetActiveSource())
+}
+
+func (backend *LibCecBackend) Transmit(message Message) {
+	if !backend.lock() {
+		return
+	}
+	defer backend.mutex.RUnlock()
+
+	backend.connection.Transmit(gocec.Message(message))
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The types below mirror those of gocec, which can only be used together with
+// libcec. Keeping them separate allows cec2mqtt to be built without libcec,
+// using the simulated or replay backend.
+
+type LogicalAddress byte
+
+const (
+	DeviceTV LogicalAddress = iota
+	DeviceRecodingDevice1
+	DeviceRecodingDevice2
+	DeviceTuner1
+	DevicePlaybackDevice1
+	DeviceAudiosystem
+	DeviceTuner2
+	DeviceTuner3
+	DevicePlaybackDevice2
+	DeviceRecodingDevice3
+	DeviceTuner4
+	DevicePlaybackDevice3
+	DeviceReserved1
+	DeviceReserved2
+	DeviceFreeUse
+	DeviceUnregistered
+	DeviceBroadcast LogicalAddress = 15
+	DeviceUnknown   LogicalAddress = 0xFF
+)
+
+var logicalAddressNames = map[LogicalAddress]string{
+	DeviceTV:              "TV",
+	DeviceRecodingDevice1: "Recorder 1",
+	DeviceRecodingDevice2: "Recorder 2",
+	DeviceTuner1:          "Tuner 1",
+	DevicePlaybackDevice1: "Playback 1",
+	DeviceAudiosystem:     "Audio",
+	DeviceTuner2:          "Tuner 2",
+	DeviceTuner3:          "Tuner 3",
+	DevicePlaybackDevice2: "Playback 2",
+	DeviceRecodingDevice3: "Recorder 3",
+	DeviceTuner4:          "Tuner 4",
+	DevicePlaybackDevice3: "Playback 3",
+	DeviceReserved1:       "Reserved 1",
+	DeviceReserved2:       "Reserved 2",
+	DeviceFreeUse:         "Free use",
+	DeviceBroadcast:       "Broadcast",
+}
+
+func (address LogicalAddress) String() string {
+	if name, ok := logicalAddressNames[address]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+type PhysicalAddress [2]byte
+
+func (address PhysicalAddress) String() string {
+	return fmt.Sprintf("%d.%d.%d.%d", address[0]>>4, address[0]&0x0F, address[1]>>4, address[1]&0x0F)
+}
+
+type Opcode byte
+
+const (
+	OpcodeActiveSource              Opcode = 0x82
+	OpcodeImageViewOn               Opcode = 0x04
+	OpcodeTextViewOn                Opcode = 0x0D
+	OpcodeInactiveSource            Opcode = 0x9D
+	OpcodeRequestActiveSource       Opcode = 0x85
+	OpcodeRoutingChange             Opcode = 0x80
+	OpcodeRoutingInformation        Opcode = 0x81
+	OpcodeSetStreamPath             Opcode = 0x86
+	OpcodeStandby                   Opcode = 0x36
+	OpcodeCecVersion                Opcode = 0x9E
+	OpcodeGetCecVersion             Opcode = 0x9F
+	OpcodeGivePhysicalAddress       Opcode = 0x83
+	OpcodeGetMenuLanguage           Opcode = 0x91
+	OpcodeReportPhysicalAddress     Opcode = 0x84
+	OpcodeSetMenuLanguage           Opcode = 0x32
+	OpcodeDeviceVendorId            Opcode = 0x87
+	OpcodeGiveDeviceVendorId        Opcode = 0x8C
+	OpcodeVendorCommand             Opcode = 0x89
+	OpcodeVendorCommandWithId       Opcode = 0xA0
+	OpcodeVendorRemoteButtonDown    Opcode = 0x8A
+	OpcodeVendorRemoteButtonUp      Opcode = 0x8B
+	OpcodeSetOsdString              Opcode = 0x64
+	OpcodeGiveOsdName               Opcode = 0x46
+	OpcodeSetOsdName                Opcode = 0x47
+	OpcodeMenuRequest               Opcode = 0x8D
+	OpcodeMenuStatus                Opcode = 0x8E
+	OpcodeUserControlPressed        Opcode = 0x44
+	OpcodeUserControlRelease        Opcode = 0x45
+	OpcodeGiveDevicePowerStatus     Opcode = 0x8F
+	OpcodeReportPowerStatus         Opcode = 0x90
+	OpcodeFeatureAbort              Opcode = 0x00
+	OpcodeAbort                     Opcode = 0xFF
+	OpcodeGiveAudioStatus           Opcode = 0x71
+	OpcodeGiveSystemAudioModeStatus Opcode = 0x7D
+	OpcodeReportAudioStatus         Opcode = 0x7A
+	OpcodeSetSystemAudioMode        Opcode = 0x72
+	OpcodeSystemAudioModeRequest    Opcode = 0x70
+	OpcodeSystemAudioModeStatus     Opcode = 0x7E
+	OpcodeNone                      Opcode = 0xFD
+)
+
+var opcodeNames = map[Opcode]string{
+	OpcodeActiveSource:              "active source",
+	OpcodeImageViewOn:               "image view on",
+	OpcodeTextViewOn:                "text view on",
+	OpcodeInactiveSource:            "inactive source",
+	OpcodeRequestActiveSource:       "request active source",
+	OpcodeRoutingChange:             "routing change",
+	OpcodeRoutingInformation:        "routing information",
+	OpcodeSetStreamPath:             "set stream path",
+	OpcodeStandby:                   "standby",
+	OpcodeCecVersion:                "cec version",
+	OpcodeGetCecVersion:             "get cec version",
+	OpcodeGivePhysicalAddress:       "give physical address",
+	OpcodeGetMenuLanguage:           "get menu language",
+	OpcodeReportPhysicalAddress:     "report physical address",
+	OpcodeSetMenuLanguage:           "set menu language",
+	OpcodeDeviceVendorId:            "device vendor id",
+	OpcodeGiveDeviceVendorId:        "give device vendor id",
+	OpcodeVendorCommand:             "vendor command",
+	OpcodeVendorCommandWithId:       "vendor command with id",
+	OpcodeVendorRemoteButtonDown:    "vendor remote button down",
+	OpcodeVendorRemoteButtonUp:      "vendor remote button up",
+	OpcodeSetOsdString:              "set osd string",
+	OpcodeGiveOsdName:               "give osd name",
+	OpcodeSetOsdName:                "set osd name",
+	OpcodeMenuRequest:               "menu request",
+	OpcodeMenuStatus:                "menu status",
+	OpcodeUserControlPressed:        "user control pressed",
+	OpcodeUserControlRelease:        "user control release",
+	OpcodeGiveDevicePowerStatus:     "give device power status",
+	OpcodeReportPowerStatus:         "report device power status",
+	OpcodeFeatureAbort:              "feature abort",
+	OpcodeAbort:                     "abort",
+	OpcodeGiveAudioStatus:           "give audio status",
+	OpcodeGiveSystemAudioModeStatus: "give system audio mode status",
+	OpcodeReportAudioStatus:         "report audio status",
+	OpcodeSetSystemAudioMode:        "set system audio mode",
+	OpcodeSystemAudioModeRequest:    "system audio mode request",
+	OpcodeSystemAudioModeStatus:     "system audio mode status",
+	OpcodeNone:                      "poll",
+}
+
+func (opcode Opcode) String() string {
+	if name, ok := opcodeNames[opcode]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("unknown (%02X)", byte(opcode))
+}
+
+type PowerStatus byte
+
+const (
+	PowerStatusOn PowerStatus = iota
+	PowerStatusStandBy
+	PowerStatusTransitionToOn
+	PowerStatusTransitionToStandby
+	PowerStatusUnknown PowerStatus = 0x99
+)
+
+func (status PowerStatus) String() string {
+	switch status {
+	case PowerStatusOn:
+		return "on"
+	case PowerStatusStandBy:
+		return "standby"
+	case PowerStatusTransitionToOn:
+		return "in transition from standby to on"
+	case PowerStatusTransitionToStandby:
+		return "in transition from on to standby"
+	default:
+		return "unknown"
+	}
+}
+
+type Vendor uint
+
+const (
+	VendorToshiba       Vendor = 0x000039
+	VendorSamsung       Vendor = 0x0000F0
+	VendorDenon         Vendor = 0x0005CD
+	VendorMarantz       Vendor = 0x000678
+	VendorLoewe         Vendor = 0x000982
+	VendorOnkyo         Vendor = 0x0009B0
+	VendorMedion        Vendor = 0x000CB8
+	VendorToshiba2      Vendor = 0x000CE7
+	VendorPulseEight    Vendor = 0x001582
+	VendorHarmanKardon2 Vendor = 0x001950
+	VendorGoogle        Vendor = 0x001A11
+	VendorAkai          Vendor = 0x0020C7
+	VendorAoc           Vendor = 0x002467
+	VendorPanasonic     Vendor = 0x008045
+	VendorPhilips       Vendor = 0x00903E
+	VendorDaewoo        Vendor = 0x009053
+	VendorYamaha        Vendor = 0x00A0DE
+	VendorGrundig       Vendor = 0x00D0D5
+	VendorPioneer       Vendor = 0x00E036
+	VendorLg            Vendor = 0x00E091
+	VendorSharp         Vendor = 0x08001F
+	VendorSony          Vendor = 0x080046
+	VendorBroadcom      Vendor = 0x18C086
+	VendorSharp2        Vendor = 0x534850
+	VendorVizio         Vendor = 0x6B746D
+	VendorBenq          Vendor = 0x8065E9
+	VendorHarmanKardon  Vendor = 0x9C645E
+	VendorUnknown       Vendor = 0
+)
+
+var vendorNames = map[Vendor]string{
+	VendorToshiba:       "Toshiba",
+	VendorSamsung:       "Samsung",
+	VendorDenon:         "Denon",
+	VendorMarantz:       "Marantz",
+	VendorLoewe:         "Loewe",
+	VendorOnkyo:         "Onkyo",
+	VendorMedion:        "Medion",
+	VendorToshiba2:      "Toshiba",
+	VendorPulseEight:    "Pulse Eight",
+	VendorHarmanKardon2: "Harman/Kardon",
+	VendorGoogle:        "Google",
+	VendorAkai:          "Akai",
+	VendorAoc:           "AOC",
+	VendorPanasonic:     "Panasonic",
+	VendorPhilips:       "Philips",
+	VendorDaewoo:        "Daewoo",
+	VendorYamaha:        "Yamaha",
+	VendorGrundig:       "Grundig",
+	VendorPioneer:       "Pioneer",
+	VendorLg:            "LG",
+	VendorSharp:         "Sharp",
+	VendorSony:          "Sony",
+	VendorBroadcom:      "Broadcom",
+	VendorSharp2:        "Sharp",
+	VendorVizio:         "Vizio",
+	VendorBenq:          "Benq",
+	VendorHarmanKardon:  "Harman/Kardon",
+}
+
+func (vendor Vendor) String() string {
+	if name, ok := vendorNames[vendor]; ok {
+		return name
+	}
+
+	return "Unknown"
+}
+
+// Message is a raw CEC frame, starting with the source and destination followed by the opcode and its parameters
+type Message []byte
+
+// ParseMessage parses a frame as written by libcec in its traffic log, like 4f:82:10:00
+func ParseMessage(message string) (Message, error) {
+	command, err := hex.DecodeString(strings.ReplaceAll(message, ":", ""))
+	if err != nil {
+		return Message{}, err
+	}
+
+	return Message(command), nil
+}
+
+func NewMessage(source LogicalAddress, destination LogicalAddress, opcode Opcode, parameters []byte) Message {
+	message := Message{
+		(byte(source) << 4) + byte(destination),
+		byte(opcode),
+	}
+
+	return append(message, parameters...)
+}
+
+func (message Message) Source() LogicalAddress {
+	return LogicalAddress(message[0] >> 4)
+}
+
+func (message Message) Destination() LogicalAddress {
+	return LogicalAddress(0x0F & message[0])
+}
+
+func (message Message) Opcode() Opcode {
+	if len(message) < 2 {
+		return OpcodeNone
+	}
+
+	return Opcode(message[1])
+}
+
+func (message Message) Parameters() []byte {
+	if len(message) < 3 {
+		return nil
+	}
+
+	return message[2:]
+}
+
+func (message Message) String() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "from %s to %s, message: %s", message.Source(), message.Destination(), message.Opcode())
+
+	if len(message) > 2 {
+		fmt.Fprintf(&builder, ", with parameters: %X", message.Parameters())
+	}
+
+	return builder.String()
+}
+
+type LogLevel int
+
+const (
+	LogLevelError   LogLevel = 1
+	LogLevelWarning LogLevel = 2
+	LogLevelNotice  LogLevel = 4
+	LogLevelTraffic LogLevel = 8
+	LogLevelDebug   LogLevel = 16
+	LogLevelAll     LogLevel = 31
+)
+
+type LogMessage struct {
+	Message string
+	Level   LogLevel
+	Time    time.Time
+}
+
+type LogCallback func(*LogMessage)
+
+type Adapter struct {
+	Path, Comm string
+}
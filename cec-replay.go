@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterCecBackend("replay", NewReplayBackend)
+}
+
+type replayedDevice struct {
+	physicalAddress PhysicalAddress
+	vendor          Vendor
+	OSD             string
+	power           PowerStatus
+}
+
+// ReplayBackend replays a recorded traffic file. Queries are answered from the
+// recording: the identity of devices from the complete recording, the power
+// status and active source as of the current position in the recording.
+type ReplayBackend struct {
+	file        string
+	speed       float64
+	records     []*TrafficRecord
+	logCallback LogCallback
+
+	mutex          sync.Mutex
+	devices        map[LogicalAddress]*replayedDevice
+	adapterAddress LogicalAddress
+	activeSource   LogicalAddress
+	closed         bool
+}
+
+func NewReplayBackend(config *Config, logCallback LogCallback) (CecBackend, error) {
+	if config.Cec.Replay.File == "" {
+		return nil, errors.New("No traffic file to replay has been configured")
+	}
+
+	records, err := ReadTrafficFile(config.Cec.Replay.File)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := &ReplayBackend{
+		file:           config.Cec.Replay.File,
+		speed:          config.Cec.Replay.Speed,
+		records:        records,
+		logCallback:    logCallback,
+		devices:        make(map[LogicalAddress]*replayedDevice),
+		adapterAddress: DeviceRecodingDevice1,
+		activeSource:   DeviceUnknown,
+	}
+
+	backend.scan()
+
+	log.WithFields(log.Fields{
+		"file":    backend.file,
+		"records": len(records),
+		"devices": len(backend.devices),
+	}).Info("Loaded traffic file to replay")
+
+	return backend, nil
+}
+
+// scan collects the identity of all devices in the recording, so these are
+// known before the messages are replayed.
+func (backend *ReplayBackend) scan() {
+	adapterFound := false
+
+	for _, record := range backend.records {
+		message := record.Message
+		if record.Direction == TrafficOutgoing {
+			if !adapterFound && message.Source() != DeviceBroadcast {
+				backend.adapterAddress = message.Source()
+				adapterFound = true
+			}
+
+			continue
+		}
+
+		parameters := message.Parameters()
+		device := backend.getDevice(message.Source())
+
+		switch message.Opcode() {
+		case OpcodeReportPhysicalAddress:
+			if len(parameters) >= 2 {
+				device.physicalAddress = PhysicalAddress{parameters[0], parameters[1]}
+			}
+		case OpcodeDeviceVendorId:
+			if len(parameters) >= 3 {
+				device.vendor = Vendor(uint(parameters[0])<<16 | uint(parameters[1])<<8 | uint(parameters[2]))
+			}
+		case OpcodeSetOsdName:
+			device.OSD = string(parameters)
+		}
+	}
+
+	delete(backend.devices, backend.adapterAddress)
+	delete(backend.devices, DeviceBroadcast)
+}
+
+func (backend *ReplayBackend) getDevice(address LogicalAddress) *replayedDevice {
+	device, ok := backend.devices[address]
+	if !ok {
+		device = &replayedDevice{
+			physicalAddress: PhysicalAddress{0xFF, 0xFF},
+			vendor:          VendorUnknown,
+			power:           PowerStatusUnknown,
+		}
+		backend.devices[address] = device
+	}
+
+	return device
+}
+
+func (backend *ReplayBackend) FindAdapters() []Adapter {
+	return []Adapter{{Path: "replay", Comm: backend.file}}
+}
+
+func (backend *ReplayBackend) Open(adapter Adapter) error {
+	go backend.replay()
+
+	return nil
+}
+
+func (backend *ReplayBackend) replay() {
+	log.WithFields(log.Fields{
+		"file":  backend.file,
+		"speed": backend.speed,
+	}).Info("Replaying traffic file")
+
+	var previous time.Time
+	for _, record := range backend.records {
+		if !previous.IsZero() && record.Time.After(previous) {
+			time.Sleep(time.Duration(float64(record.Time.Sub(previous)) / backend.speed))
+		}
+		previous = record.Time
+
+		if backend.isClosed() {
+			return
+		}
+
+		backend.apply(record)
+
+		backend.logCallback(&LogMessage{
+			Message: record.LogLine(),
+			Level:   LogLevelTraffic,
+			Time:    record.Time,
+		})
+	}
+
+	log.WithFields(log.Fields{
+		"file": backend.file,
+	}).Info("Finished replaying traffic file")
+}
+
+// Close stops the replay, which is done when the backend is replaced
+func (backend *ReplayBackend) Close() {
+	backend.mutex.Lock()
+	backend.closed = true
+	backend.mutex.Unlock()
+}
+
+func (backend *ReplayBackend) isClosed() bool {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	return backend.closed
+}
+
+// apply updates the state of the devices with the replayed message
+func (backend *ReplayBackend) apply(record *TrafficRecord) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	message := record.Message
+	parameters := message.Parameters()
+
+	switch message.Opcode() {
+	case OpcodeReportPowerStatus:
+		if record.Direction == TrafficIncoming && len(parameters) >= 1 {
+			backend.getDevice(message.Source()).power = PowerStatus(parameters[0])
+		}
+	case OpcodeActiveSource:
+		backend.activeSource = message.Source()
+	case OpcodeInactiveSource:
+		if backend.activeSource == message.Source() {
+			backend.activeSource = DeviceUnknown
+		}
+	case OpcodeSetStreamPath:
+		if len(parameters) >= 2 {
+			physicalAddress := PhysicalAddress{parameters[0], parameters[1]}
+			for address, device := range backend.devices {
+				if device.physicalAddress == physicalAddress {
+					backend.activeSource = address
+				}
+			}
+		}
+	case OpcodeStandby:
+		if message.Source() == DeviceTV || message.Destination() == DeviceBroadcast {
+			backend.activeSource = DeviceUnknown
+		}
+	}
+}
+
+func (backend *ReplayBackend) GetAdapterAddress() (LogicalAddress, error) {
+	return backend.adapterAddress, nil
+}
+
+func (backend *ReplayBackend) ActiveDevices() []LogicalAddress {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	addresses := []LogicalAddress{backend.adapterAddress}
+	for address := range backend.devices {
+		addresses = append(addresses, address)
+	}
+
+	return addresses
+}
+
+func (backend *ReplayBackend) GetPowerStatus(address LogicalAddress) PowerStatus {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	if device, ok := backend.devices[address]; ok {
+		return device.power
+	}
+
+	return PowerStatusUnknown
+}
+
+func (backend *ReplayBackend) GetPhysicalAddress(address LogicalAddress) PhysicalAddress {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	if device, ok := backend.devices[address]; ok {
+		return device.physicalAddress
+	}
+
+	return PhysicalAddress{0xFF, 0xFF}
+}
+
+func (backend *ReplayBackend) GetVendor(address LogicalAddress) Vendor {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	if device, ok := backend.devices[address]; ok {
+		return device.vendor
+	}
+
+	return VendorUnknown
+}
+
+func (backend *ReplayBackend) GetOSDName(address LogicalAddress) string {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	if device, ok := backend.devices[address]; ok {
+		return device.OSD
+	}
+
+	return ""
+}
+
+func (backend *ReplayBackend) PowerOnDevice(address LogicalAddress) {
+	log.WithFields(log.Fields{
+		"logical_address": address,
+	}).Info("Not powering on device as traffic is being replayed")
+}
+
+func (backend *ReplayBackend) StandByDevice(address LogicalAddress) {
+	log.WithFields(log.Fields{
+		"logical_address": address,
+	}).Info("Not putting device into standby as traffic is being replayed")
+}
+
+func (backend *ReplayBackend) GetActiveSource() LogicalAddress {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	return backend.activeSource
+}
+
+func (backend *ReplayBackend) Transmit(message Message) {
+	log.WithFields(log.Fields{
+		"message.raw": []byte(message),
+	}).Debug("Not transmitting message as traffic is being replayed")
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterCecBackend("simulated", NewSimulatedBus)
+}
+
+const (
+	cecVersion14 byte = 0x05
+
+	userControlPower    byte = 0x40
+	userControlPowerOff byte = 0x6C
+	userControlPowerOn  byte = 0x6D
+
+	// Like libcec, the power status is only requested from the device when the
+	// cached status is older than this
+	simulatedPowerStatusRefresh = 30 * time.Second
+)
+
+var defaultSimulatedDevices = []SimulatedDeviceConfig{
+	{LogicalAddress: 0, PhysicalAddress: "0.0.0.0", VendorId: int(VendorLg), OSD: "TV", Power: "standby"},
+	{LogicalAddress: 5, PhysicalAddress: "1.0.0.0", VendorId: int(VendorDenon), OSD: "AVR", Power: "standby"},
+	{LogicalAddress: 4, PhysicalAddress: "1.1.0.0", VendorId: int(VendorGoogle), OSD: "Chromecast", Power: "standby"},
+	{LogicalAddress: 8, PhysicalAddress: "2.0.0.0", VendorId: int(VendorSony), OSD: "PlayStation 4", Power: "standby"},
+}
+
+type simulatedDevice struct {
+	logicalAddress  LogicalAddress
+	physicalAddress PhysicalAddress
+	vendor          Vendor
+	OSD             string
+	power           PowerStatus
+
+	lastPowerQuery time.Time
+	queried        map[Opcode]bool
+}
+
+// SimulatedBus is a pure Go CEC bus with virtual devices which respond to the
+// standard opcodes. All traffic is reported to the log callback the same way
+// libcec does, so it flows through the normal message handling.
+type SimulatedBus struct {
+	mutex          sync.Mutex
+	devices        map[LogicalAddress]*simulatedDevice
+	adapterAddress LogicalAddress
+	activeSource   LogicalAddress
+
+	logCallback LogCallback
+	logQueue    []*LogMessage
+	logMutex    sync.Mutex
+	logCond     *sync.Cond
+	closed      bool
+}
+
+func NewSimulatedBus(config *Config, logCallback LogCallback) (CecBackend, error) {
+	deviceConfigs := config.Cec.Simulation.Devices
+	if len(deviceConfigs) == 0 {
+		deviceConfigs = defaultSimulatedDevices
+	}
+
+	bus := &SimulatedBus{
+		devices:        make(map[LogicalAddress]*simulatedDevice),
+		adapterAddress: DeviceRecodingDevice1,
+		activeSource:   DeviceUnknown,
+		logCallback:    logCallback,
+	}
+	bus.logCond = sync.NewCond(&bus.logMutex)
+
+	for _, deviceConfig := range deviceConfigs {
+		device, err := newSimulatedDevice(deviceConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		if device.logicalAddress == bus.adapterAddress {
+			return nil, errors.New("Simulated device " + device.OSD + " uses the logical address of the adapter")
+		}
+
+		bus.devices[device.logicalAddress] = device
+	}
+
+	go bus.deliverLogs()
+
+	return bus, nil
+}
+
+func newSimulatedDevice(config SimulatedDeviceConfig) (*simulatedDevice, error) {
+	if config.LogicalAddress < 0 || config.LogicalAddress >= int(DeviceBroadcast) {
+		return nil, fmt.Errorf("Simulated device %s has invalid logical address %d", config.OSD, config.LogicalAddress)
+	}
+
+	var a, b, c, d byte
+	if _, err := fmt.Sscanf(config.PhysicalAddress, "%d.%d.%d.%d", &a, &b, &c, &d); err != nil {
+		return nil, fmt.Errorf("Simulated device %s has invalid physical address %s", config.OSD, config.PhysicalAddress)
+	}
+
+	power := PowerStatusStandBy
+	if config.Power == "on" {
+		power = PowerStatusOn
+	}
+
+	return &simulatedDevice{
+		logicalAddress:  LogicalAddress(config.LogicalAddress),
+		physicalAddress: PhysicalAddress{a<<4 | b&0x0F, c<<4 | d&0x0F},
+		vendor:          Vendor(config.VendorId),
+		OSD:             config.OSD,
+		power:           power,
+		queried:         make(map[Opcode]bool),
+	}, nil
+}
+
+func (bus *SimulatedBus) FindAdapters() []Adapter {
+	return []Adapter{{Path: "simulated", Comm: "simulated"}}
+}
+
+func (bus *SimulatedBus) Open(adapter Adapter) error {
+	bus.log(LogLevelNotice, "connection opened to simulated bus")
+
+	bus.mutex.Lock()
+	addresses := make([]LogicalAddress, 0, len(bus.devices))
+	for address := range bus.devices {
+		addresses = append(addresses, address)
+	}
+	bus.mutex.Unlock()
+
+	// Mimic libcec polling the bus for devices when the connection is opened
+	for _, address := range addresses {
+		bus.send(Message{byte(bus.adapterAddress)<<4 | byte(address)})
+	}
+
+	return nil
+}
+
+func (bus *SimulatedBus) GetAdapterAddress() (LogicalAddress, error) {
+	return bus.adapterAddress, nil
+}
+
+func (bus *SimulatedBus) ActiveDevices() []LogicalAddress {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	addresses := []LogicalAddress{bus.adapterAddress}
+	for address := range bus.devices {
+		addresses = append(addresses, address)
+	}
+
+	return addresses
+}
+
+func (bus *SimulatedBus) GetPowerStatus(address LogicalAddress) PowerStatus {
+	bus.mutex.Lock()
+	device, ok := bus.devices[address]
+	refresh := !ok || time.Since(device.lastPowerQuery) > simulatedPowerStatusRefresh
+	if ok && refresh {
+		device.lastPowerQuery = time.Now()
+	}
+	bus.mutex.Unlock()
+
+	if refresh {
+		bus.query(address, OpcodeGiveDevicePowerStatus)
+	}
+
+	if !ok {
+		return PowerStatusUnknown
+	}
+
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	return device.power
+}
+
+func (bus *SimulatedBus) GetPhysicalAddress(address LogicalAddress) PhysicalAddress {
+	device := bus.queryOnce(address, OpcodeGivePhysicalAddress)
+	if device == nil {
+		return PhysicalAddress{0xFF, 0xFF}
+	}
+
+	return device.physicalAddress
+}
+
+func (bus *SimulatedBus) GetVendor(address LogicalAddress) Vendor {
+	device := bus.queryOnce(address, OpcodeGiveDeviceVendorId)
+	if device == nil {
+		return VendorUnknown
+	}
+
+	return device.vendor
+}
+
+func (bus *SimulatedBus) GetOSDName(address LogicalAddress) string {
+	device := bus.queryOnce(address, OpcodeGiveOsdName)
+	if device == nil {
+		return ""
+	}
+
+	return device.OSD
+}
+
+func (bus *SimulatedBus) PowerOnDevice(address LogicalAddress) {
+	if address == DeviceTV {
+		bus.query(address, OpcodeImageViewOn)
+		return
+	}
+
+	bus.send(NewMessage(bus.adapterAddress, address, OpcodeUserControlPressed, []byte{userControlPowerOn}))
+	bus.query(address, OpcodeUserControlRelease)
+}
+
+func (bus *SimulatedBus) StandByDevice(address LogicalAddress) {
+	bus.query(address, OpcodeStandby)
+}
+
+// GetActiveSource returns the active source as known by the bus. Like libcec
+// this doesn't result in any traffic.
+func (bus *SimulatedBus) GetActiveSource() LogicalAddress {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	return bus.activeSource
+}
+
+func (bus *SimulatedBus) Transmit(message Message) {
+	bus.send(message)
+}
+
+func (bus *SimulatedBus) query(address LogicalAddress, opcode Opcode) {
+	bus.send(NewMessage(bus.adapterAddress, address, opcode, []byte{}))
+}
+
+// queryOnce sends a query to a device the first time it's requested, after
+// which the answer is considered to be known, like libcec caches these.
+func (bus *SimulatedBus) queryOnce(address LogicalAddress, opcode Opcode) *simulatedDevice {
+	bus.mutex.Lock()
+	device, ok := bus.devices[address]
+	queried := ok && device.queried[opcode]
+	if ok {
+		device.queried[opcode] = true
+	}
+	bus.mutex.Unlock()
+
+	if !queried {
+		bus.query(address, opcode)
+	}
+
+	return device
+}
+
+// send puts a message on the bus and lets every addressed device handle it,
+// including the messages the devices send in response.
+func (bus *SimulatedBus) send(message Message) {
+	if len(message) == 0 {
+		return
+	}
+
+	bus.log(LogLevelTraffic, "<< "+formatFrame(message))
+
+	bus.mutex.Lock()
+	_, present := bus.devices[message.Destination()]
+	queue := bus.handle(message)
+	bus.mutex.Unlock()
+
+	// Like libcec, report messages to absent devices as not acknowledged
+	if !present && message.Destination() != DeviceBroadcast {
+		bus.log(LogLevelDebug, "command '"+formatFrame(message)+"' was not acked")
+	}
+
+	for len(queue) > 0 {
+		response := queue[0]
+		queue = queue[1:]
+
+		bus.log(LogLevelTraffic, ">> "+formatFrame(response))
+
+		bus.mutex.Lock()
+		queue = append(queue, bus.handle(response)...)
+		bus.mutex.Unlock()
+	}
+}
+
+// handle processes a message on all devices it's addressed to and returns
+// the messages sent in response. The bus must be locked.
+func (bus *SimulatedBus) handle(message Message) []Message {
+	if len(message) < 2 {
+		// Polling message, which is just acked
+		return nil
+	}
+
+	responses := make([]Message, 0)
+
+	if message.Opcode() == OpcodeActiveSource && len(message.Parameters()) >= 2 {
+		bus.activeSource = message.Source()
+	}
+
+	for address, device := range bus.devices {
+		if address == message.Source() {
+			continue
+		}
+
+		if message.Destination() == address || message.Destination() == DeviceBroadcast {
+			responses = append(responses, bus.handleOnDevice(device, message)...)
+		}
+	}
+
+	return responses
+}
+
+func (bus *SimulatedBus) handleOnDevice(device *simulatedDevice, message Message) []Message {
+	source := device.logicalAddress
+	parameters := message.Parameters()
+
+	switch message.Opcode() {
+	case OpcodeGiveDevicePowerStatus:
+		return []Message{NewMessage(source, message.Source(), OpcodeReportPowerStatus, []byte{byte(device.power)})}
+	case OpcodeGivePhysicalAddress:
+		return []Message{bus.reportPhysicalAddress(device)}
+	case OpcodeGiveDeviceVendorId:
+		return []Message{NewMessage(source, DeviceBroadcast, OpcodeDeviceVendorId, []byte{
+			byte(device.vendor >> 16), byte(device.vendor >> 8), byte(device.vendor),
+		})}
+	case OpcodeGiveOsdName:
+		return []Message{NewMessage(source, message.Source(), OpcodeSetOsdName, []byte(device.OSD))}
+	case OpcodeGetCecVersion:
+		return []Message{NewMessage(source, message.Source(), OpcodeCecVersion, []byte{cecVersion14})}
+	case OpcodeRequestActiveSource:
+		if bus.activeSource == source && device.power == PowerStatusOn {
+			return []Message{bus.activeSourceMessage(device)}
+		}
+	case OpcodeImageViewOn, OpcodeTextViewOn:
+		if source == DeviceTV {
+			device.power = PowerStatusOn
+		}
+	case OpcodeStandby:
+		device.power = PowerStatusStandBy
+		if bus.activeSource == source {
+			bus.activeSource = DeviceUnknown
+		}
+	case OpcodeSetStreamPath:
+		if len(parameters) >= 2 && (PhysicalAddress{parameters[0], parameters[1]}) == device.physicalAddress {
+			device.power = PowerStatusOn
+			return []Message{bus.activeSourceMessage(device)}
+		}
+	case OpcodeUserControlPressed:
+		if len(parameters) < 1 {
+			return nil
+		}
+
+		switch parameters[0] {
+		case userControlPower:
+			if device.power == PowerStatusOn {
+				return bus.standby(device)
+			}
+
+			return bus.powerOn(device)
+		case userControlPowerOn:
+			return bus.powerOn(device)
+		case userControlPowerOff:
+			return bus.standby(device)
+		}
+	case OpcodeUserControlRelease, OpcodeActiveSource, OpcodeReportPowerStatus,
+		OpcodeReportPhysicalAddress, OpcodeDeviceVendorId, OpcodeSetOsdName,
+		OpcodeCecVersion, OpcodeFeatureAbort:
+		// Informational messages which don't require a response
+	default:
+		if message.Destination() != DeviceBroadcast {
+			return []Message{NewMessage(source, message.Source(), OpcodeFeatureAbort, []byte{byte(message.Opcode()), 0x00})}
+		}
+	}
+
+	return nil
+}
+
+// powerOn turns on a device the way most players do, by turning on the TV and
+// making itself the active source.
+func (bus *SimulatedBus) powerOn(device *simulatedDevice) []Message {
+	if device.power == PowerStatusOn {
+		return nil
+	}
+
+	device.power = PowerStatusOn
+
+	if device.logicalAddress == DeviceTV || device.logicalAddress == DeviceAudiosystem {
+		return nil
+	}
+
+	return []Message{
+		NewMessage(device.logicalAddress, DeviceTV, OpcodeImageViewOn, []byte{}),
+		bus.activeSourceMessage(device),
+	}
+}
+
+func (bus *SimulatedBus) standby(device *simulatedDevice) []Message {
+	device.power = PowerStatusStandBy
+
+	if bus.activeSource == device.logicalAddress {
+		bus.activeSource = DeviceUnknown
+	}
+
+	if device.logicalAddress == DeviceTV {
+		return []Message{NewMessage(device.logicalAddress, DeviceBroadcast, OpcodeStandby, []byte{})}
+	}
+
+	return nil
+}
+
+func (bus *SimulatedBus) activeSourceMessage(device *simulatedDevice) Message {
+	return NewMessage(device.logicalAddress, DeviceBroadcast, OpcodeActiveSource, device.physicalAddress[:])
+}
+
+func (bus *SimulatedBus) reportPhysicalAddress(device *simulatedDevice) Message {
+	var deviceType byte
+	switch device.logicalAddress {
+	case DeviceTV:
+		deviceType = 0
+	case DeviceRecodingDevice1, DeviceRecodingDevice2, DeviceRecodingDevice3:
+		deviceType = 1
+	case DeviceTuner1, DeviceTuner2, DeviceTuner3, DeviceTuner4:
+		deviceType = 3
+	case DevicePlaybackDevice1, DevicePlaybackDevice2, DevicePlaybackDevice3:
+		deviceType = 4
+	case DeviceAudiosystem:
+		deviceType = 5
+	}
+
+	return NewMessage(device.logicalAddress, DeviceBroadcast, OpcodeReportPhysicalAddress, []byte{
+		device.physicalAddress[0], device.physicalAddress[1], deviceType,
+	})
+}
+
+// log queues a message for the log callback. The callback is invoked from a
+// separate goroutine, like libcec does, so handlers can query the bus again.
+func (bus *SimulatedBus) log(level LogLevel, message string) {
+	bus.logMutex.Lock()
+	bus.logQueue = append(bus.logQueue, &LogMessage{
+		Message: message,
+		Level:   level,
+		Time:    time.Now(),
+	})
+	bus.logMutex.Unlock()
+
+	bus.logCond.Signal()
+}
+
+// Close stops delivering the traffic of the bus, which is done when the backend is replaced
+func (bus *SimulatedBus) Close() {
+	bus.logMutex.Lock()
+	bus.closed = true
+	bus.logMutex.Unlock()
+
+	bus.logCond.Broadcast()
+}
+
+func (bus *SimulatedBus) deliverLogs() {
+	for {
+		bus.logMutex.Lock()
+		for len(bus.logQueue) == 0 && !bus.closed {
+			bus.logCond.Wait()
+		}
+
+		if bus.closed {
+			bus.logMutex.Unlock()
+			return
+		}
+
+		message := bus.logQueue[0]
+		bus.logQueue = bus.logQueue[1:]
+		bus.logMutex.Unlock()
+
+		bus.logCallback(message)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSimulatedBus(t *testing.T) (*SimulatedBus, chan *LogMessage) {
+	config := &Config{}
+	config.Cec.Simulation.Devices = []SimulatedDeviceConfig{
+		{LogicalAddress: 0, PhysicalAddress: "0.0.0.0", VendorId: int(VendorLg), OSD: "TV", Power: "standby"},
+		{LogicalAddress: 4, PhysicalAddress: "1.0.0.0", VendorId: int(VendorGoogle), OSD: "Chromecast", Power: "standby"},
+	}
+
+	logs := make(chan *LogMessage, 100)
+	backend, err := NewSimulatedBus(config, func(message *LogMessage) {
+		logs <- message
+	})
+	if err != nil {
+		t.Fatalf("Failed to create simulated bus: %v", err)
+	}
+
+	bus := backend.(*SimulatedBus)
+	t.Cleanup(bus.Close)
+
+	if err := bus.Open(Adapter{Path: "simulated", Comm: "simulated"}); err != nil {
+		t.Fatalf("Failed to open simulated bus: %v", err)
+	}
+
+	return bus, logs
+}
+
+// waitForTraffic waits until the frame has been reported as received traffic
+func waitForTraffic(t *testing.T, logs chan *LogMessage, frame string) {
+	t.Helper()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case message := <-logs:
+			if message.Level == LogLevelTraffic && strings.HasPrefix(message.Message, ">> "+frame) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Frame %s has not been received", frame)
+		}
+	}
+}
+
+func TestSimulatedBusPowerRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		address LogicalAddress
+	}{
+		{"tv", DeviceTV},
+		{"playback", DevicePlaybackDevice1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bus, logs := newTestSimulatedBus(t)
+
+			if status := bus.GetPowerStatus(test.address); status != PowerStatusStandBy {
+				t.Fatalf("Expected device to be in standby, got %s", status)
+			}
+
+			bus.PowerOnDevice(test.address)
+			if status := bus.GetPowerStatus(test.address); status != PowerStatusOn {
+				t.Fatalf("Expected device to be on, got %s", status)
+			}
+
+			bus.StandByDevice(test.address)
+			if status := bus.GetPowerStatus(test.address); status != PowerStatusStandBy {
+				t.Fatalf("Expected device to be in standby, got %s", status)
+			}
+
+			// The device reports its power status, which is how cec2mqtt learns about the change
+			request := NewMessage(DeviceRecodingDevice1, test.address, OpcodeGiveDevicePowerStatus, []byte{})
+			bus.Transmit(request)
+
+			response := NewMessage(test.address, DeviceRecodingDevice1, OpcodeReportPowerStatus, []byte{byte(PowerStatusStandBy)})
+			waitForTraffic(t, logs, formatFrame(response))
+		})
+	}
+}
+
+func TestSimulatedBusUnknownDevice(t *testing.T) {
+	bus, _ := newTestSimulatedBus(t)
+
+	if status := bus.GetPowerStatus(DeviceTuner1); status != PowerStatusUnknown {
+		t.Errorf("Expected unknown power status for absent device, got %s", status)
+	}
+
+	if address := bus.GetPhysicalAddress(DeviceTuner1); address != (PhysicalAddress{0xFF, 0xFF}) {
+		t.Errorf("Expected invalid physical address for absent device, got %s", address)
+	}
+}
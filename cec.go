@@ -2,53 +2,100 @@ package main
 
 import (
 	"errors"
-	"github.com/RobertMe/gocec"
 	log "github.com/sirupsen/logrus"
 	"strings"
+	"sync"
+	"time"
 )
 
-type MessageReceivedHandler func(message gocec.Message)
+type MessageReceivedHandler func(message Message)
+type ReconnectedHandler func()
+
+// TransmitHandler is called for a message sent by cec2mqtt, acked is false
+// when libcec reports the message hasn't been acknowledged.
+type TransmitHandler func(message Message, acked bool)
 
 type Cec struct {
-	connection *gocec.Connection
-	adapter    gocec.Adapter
+	backend      CecBackend
+	adapter      Adapter
+	config       *Config
+	backendMutex sync.RWMutex
 
 	devices                 *DeviceRegistry
-	messageReceivedHandlers map[gocec.Opcode][]MessageReceivedHandler
+	messageReceivedHandlers map[Opcode][]MessageReceivedHandler
+	reconnectedHandlers     []ReconnectedHandler
+	transmitHandlers        []TransmitHandler
 	LibCecLoggingEnabled    bool
+	Capture                 *TrafficCapture
+
+	healthMutex       sync.Mutex
+	lastReceived      time.Time
+	consecutiveErrors int
+
+	// Totals since the start, for the statistics of the bridge
+	statsMutex  sync.Mutex
+	received    int
+	transmitted int
+	errors      int
+
+	transmitMutex   sync.Mutex
+	lastTransmitted Message
 }
 
 type CecDeviceDescription struct {
-	logicalAddress  gocec.LogicalAddress
-	physicalAddress gocec.PhysicalAddress
-	vendor          gocec.Vendor
+	logicalAddress  LogicalAddress
+	physicalAddress PhysicalAddress
+	vendor          Vendor
 	OSD             string
 }
 
-func InitialiseCec(devices *DeviceRegistry, path string) (*Cec, error) {
-	config := gocec.NewConfiguration("cec2mqtt", false)
-
-	config.SetMonitorOnly(false)
-	config.SetActivateSource(false)
-
+func InitialiseCec(devices *DeviceRegistry, config *Config) (*Cec, error) {
 	cec := &Cec{
+		config:                  config,
 		devices:                 devices,
-		messageReceivedHandlers: make(map[gocec.Opcode][]MessageReceivedHandler),
+		messageReceivedHandlers: make(map[Opcode][]MessageReceivedHandler),
+		reconnectedHandlers:     make([]ReconnectedHandler, 0),
+		transmitHandlers:        make([]TransmitHandler, 0),
 	}
-	config.SetLogCallback(cec.handleLogMessage)
 
-	connection, err := gocec.NewConnection(config)
+	backend, adapter, err := cec.connect()
 	if err != nil {
 		return nil, err
 	}
 
-	var adapter gocec.Adapter
-	adapters := connection.FindAdapters()
+	cec.backend = backend
+	cec.adapter = adapter
+
+	return cec, nil
+}
+
+func (cec *Cec) connect() (CecBackend, Adapter, error) {
+	factory, ok := cecBackends[cec.config.Cec.Backend]
+	if !ok {
+		return nil, Adapter{}, errors.New("CEC backend " + cec.config.Cec.Backend + " does not exist")
+	}
+
+	log.WithFields(log.Fields{
+		"backend": cec.config.Cec.Backend,
+	}).Debug("Creating CEC backend")
+
+	backend, err := factory(cec.config, cec.handleLogMessage)
+	if err != nil {
+		return nil, Adapter{}, err
+	}
+
+	var adapter Adapter
+	adapters := backend.FindAdapters()
 
 	log.WithFields(log.Fields{
 		"adapters": adapters,
 	}).Debug("Adapters found")
 
+	if len(adapters) == 0 {
+		return nil, Adapter{}, errors.New("No CEC adapters have been found")
+	}
+
+	path := cec.config.Cec.Adapter
 	if len(path) == 0 {
 		adapter = adapters[0]
 
@@ -61,11 +108,12 @@ func InitialiseCec(devices *DeviceRegistry, path string) (*Cec, error) {
 		for _, adapter = range adapters {
 			if adapter.Path == path {
 				found = true
+				break
 			}
 		}
 
 		if !found {
-			return nil, errors.New("Adapter " + path + " has not been found")
+			return nil, Adapter{}, errors.New("Adapter " + path + " has not been found")
 		}
 
 		log.WithFields(log.Fields{
@@ -73,13 +121,10 @@ func InitialiseCec(devices *DeviceRegistry, path string) (*Cec, error) {
 		}).Debug("Matched adapter")
 	}
 
-	cec.connection = connection
-	cec.adapter = adapter
-
-	return cec, nil
+	return backend, adapter, nil
 }
 
-func (cec *Cec) RegisterMessageHandler(handler MessageReceivedHandler, opcodes ...gocec.Opcode) {
+func (cec *Cec) RegisterMessageHandler(handler MessageReceivedHandler, opcodes ...Opcode) {
 	log.WithFields(log.Fields{
 		"opcodes": opcodes,
 	}).Trace("Registering message handler")
@@ -94,17 +139,78 @@ func (cec *Cec) RegisterMessageHandler(handler MessageReceivedHandler, opcodes .
 	}
 }
 
+func (cec *Cec) RegisterReconnectedHandler(handler ReconnectedHandler) {
+	cec.reconnectedHandlers = append(cec.reconnectedHandlers, handler)
+}
+
+// RegisterTransmitHandler registers a handler which is called when a message is
+// sent, and again when libcec reports it hasn't been acknowledged.
+func (cec *Cec) RegisterTransmitHandler(handler TransmitHandler) {
+	cec.transmitHandlers = append(cec.transmitHandlers, handler)
+}
+
 func (cec *Cec) Start() error {
-	if err := cec.connection.Open(cec.adapter); err != nil {
+	cec.backendMutex.RLock()
+	backend, adapter := cec.backend, cec.adapter
+	cec.backendMutex.RUnlock()
+
+	if err := backend.Open(adapter); err != nil {
 		return err
 	}
 
 	log.WithFields(log.Fields{
-		"adapter": cec.adapter,
+		"adapter": adapter,
 	}).Info("Opened CEC connection")
 
-	adapterAddress, _ := cec.connection.GetAdapterAddress()
-	addresses := cec.connection.ActiveDevices()
+	cec.resetHealth()
+	cec.Scan()
+
+	return nil
+}
+
+// Restart sets up a new backend for the adapter, replacing the current one,
+// and rescans the bus.
+func (cec *Cec) Restart() error {
+	log.Info("Restarting CEC connection")
+
+	// The current backend may still hold the adapter, so it's closed before the adapter is opened again
+	if closer, ok := cec.getBackend().(CecBackendCloser); ok {
+		closer.Close()
+	}
+
+	backend, adapter, err := cec.connect()
+	if err != nil {
+		return err
+	}
+
+	if err := backend.Open(adapter); err != nil {
+		return err
+	}
+
+	cec.backendMutex.Lock()
+	cec.backend = backend
+	cec.adapter = adapter
+	cec.backendMutex.Unlock()
+
+	log.WithFields(log.Fields{
+		"adapter": adapter,
+	}).Info("Reopened CEC connection")
+
+	cec.resetHealth()
+	cec.Scan()
+
+	for _, handler := range cec.reconnectedHandlers {
+		handler()
+	}
+
+	return nil
+}
+
+func (cec *Cec) Scan() {
+	backend := cec.getBackend()
+
+	adapterAddress, _ := backend.GetAdapterAddress()
+	addresses := backend.ActiveDevices()
 
 	for _, address := range addresses {
 		// Don't register a device for the CEC adapter
@@ -119,11 +225,82 @@ func (cec *Cec) Start() error {
 			}).Trace("Skipping active device as it's the adapter")
 		}
 	}
+}
 
-	return nil
+// AdapterPresent checks whether the adapter in use can still be found.
+func (cec *Cec) AdapterPresent() bool {
+	cec.backendMutex.RLock()
+	backend, adapter := cec.backend, cec.adapter
+	cec.backendMutex.RUnlock()
+
+	for _, found := range backend.FindAdapters() {
+		if found.Comm == adapter.Comm {
+			return true
+		}
+	}
+
+	return false
 }
 
-func (cec *Cec) handleLogMessage(logMessage *gocec.LogMessage) {
+// Adapter returns the adapter which is in use, together with its logical address
+func (cec *Cec) Adapter() (Adapter, LogicalAddress) {
+	cec.backendMutex.RLock()
+	backend, adapter := cec.backend, cec.adapter
+	cec.backendMutex.RUnlock()
+
+	address, err := backend.GetAdapterAddress()
+	if err != nil {
+		address = DeviceUnknown
+	}
+
+	return adapter, address
+}
+
+// Probe asks the TV for its power status, which should result in incoming
+// traffic when the connection is still working.
+func (cec *Cec) Probe() {
+	cec.getBackend().GetPowerStatus(DeviceTV)
+}
+
+func (cec *Cec) LastReceived() time.Time {
+	cec.healthMutex.Lock()
+	defer cec.healthMutex.Unlock()
+
+	return cec.lastReceived
+}
+
+func (cec *Cec) ConsecutiveErrors() int {
+	cec.healthMutex.Lock()
+	defer cec.healthMutex.Unlock()
+
+	return cec.consecutiveErrors
+}
+
+// Stats returns the number of messages received and transmitted, and the number
+// of errors reported by libcec, since the start.
+func (cec *Cec) Stats() (received int, transmitted int, errors int) {
+	cec.statsMutex.Lock()
+	defer cec.statsMutex.Unlock()
+
+	return cec.received, cec.transmitted, cec.errors
+}
+
+func (cec *Cec) resetHealth() {
+	cec.healthMutex.Lock()
+	defer cec.healthMutex.Unlock()
+
+	cec.lastReceived = time.Now()
+	cec.consecutiveErrors = 0
+}
+
+func (cec *Cec) getBackend() CecBackend {
+	cec.backendMutex.RLock()
+	defer cec.backendMutex.RUnlock()
+
+	return cec.backend
+}
+
+func (cec *Cec) handleLogMessage(logMessage *LogMessage) {
 	if cec.LibCecLoggingEnabled {
 		log.WithFields(log.Fields{
 			"message": logMessage.Message,
@@ -132,7 +309,55 @@ func (cec *Cec) handleLogMessage(logMessage *gocec.LogMessage) {
 		}).Debug("Incoming message from libcec")
 	}
 
-	if logMessage.Level != gocec.LogLevelTraffic {
+	if logMessage.Level == LogLevelError {
+		cec.healthMutex.Lock()
+		cec.consecutiveErrors++
+		cec.healthMutex.Unlock()
+
+		cec.statsMutex.Lock()
+		cec.errors++
+		cec.statsMutex.Unlock()
+	}
+
+	// libcec doesn't report whether a message has been acknowledged, other than by logging it hasn't
+	if logMessage.Level != LogLevelTraffic && strings.Contains(strings.ToLower(logMessage.Message), "not acked") {
+		cec.transmitMutex.Lock()
+		message := cec.lastTransmitted
+		cec.lastTransmitted = nil
+		cec.transmitMutex.Unlock()
+
+		if message != nil {
+			for _, handler := range cec.transmitHandlers {
+				handler(message, false)
+			}
+		}
+	}
+
+	if logMessage.Level != LogLevelTraffic {
+		return
+	}
+
+	if cec.Capture != nil {
+		if record := NewTrafficRecord(logMessage); record != nil {
+			cec.Capture.Write(record)
+		}
+	}
+
+	if strings.HasPrefix(logMessage.Message, "<< ") {
+		if message, err := ParseMessage(logMessage.Message[3:]); err == nil && len(message) > 0 {
+			cec.statsMutex.Lock()
+			cec.transmitted++
+			cec.statsMutex.Unlock()
+
+			cec.transmitMutex.Lock()
+			cec.lastTransmitted = message
+			cec.transmitMutex.Unlock()
+
+			for _, handler := range cec.transmitHandlers {
+				handler(message, true)
+			}
+		}
+
 		return
 	}
 
@@ -140,7 +365,13 @@ func (cec *Cec) handleLogMessage(logMessage *gocec.LogMessage) {
 		return
 	}
 
-	message, _ := gocec.ParseMessage(logMessage.Message[3:])
+	cec.resetHealth()
+
+	cec.statsMutex.Lock()
+	cec.received++
+	cec.statsMutex.Unlock()
+
+	message, _ := ParseMessage(logMessage.Message[3:])
 
 	device := cec.GetDevice(message.Source())
 
@@ -148,6 +379,8 @@ func (cec *Cec) handleLogMessage(logMessage *gocec.LogMessage) {
 		return
 	}
 
+	device.Seen()
+
 	context := log.WithFields(log.Fields{
 		"raw_message":            logMessage.Message[3:],
 		"parsed_message":         message,
@@ -167,27 +400,73 @@ func (cec *Cec) handleLogMessage(logMessage *gocec.LogMessage) {
 	}
 }
 
-func (cec *Cec) GetDevice(address gocec.LogicalAddress) *Device {
-	if address == gocec.DeviceBroadcast {
+func (cec *Cec) GetDevice(address LogicalAddress) *Device {
+	if address == DeviceBroadcast {
 		return nil
 	}
 
 	creator := func() *CecDeviceDescription {
+		backend := cec.getBackend()
+
 		return &CecDeviceDescription{
 			logicalAddress:  address,
-			physicalAddress: cec.connection.GetPhysicalAddress(address),
-			vendor:          cec.connection.GetVendor(address),
-			OSD:             cec.connection.GetOSDName(address),
+			physicalAddress: backend.GetPhysicalAddress(address),
+			vendor:          backend.GetVendor(address),
+			OSD:             backend.GetOSDName(address),
 		}
 	}
 
 	return cec.devices.GetByCecDevice(address, creator)
 }
 
-func (cec *Cec) Transmit(message gocec.Message) {
+func (cec *Cec) Transmit(message Message) {
 	log.WithFields(log.Fields{
 		"message.text": message.String(),
 		"message.raw":  []byte(message),
 	}).Trace("Transmitting CEC message")
-	cec.connection.Transmit(message)
+	cec.getBackend().Transmit(message)
+}
+
+func (cec *Cec) GetPowerStatus(address LogicalAddress) PowerStatus {
+	return cec.getBackend().GetPowerStatus(address)
+}
+
+func (cec *Cec) PowerOnDevice(address LogicalAddress) {
+	cec.getBackend().PowerOnDevice(address)
+}
+
+func (cec *Cec) StandByDevice(address LogicalAddress) {
+	cec.getBackend().StandByDevice(address)
+}
+
+// SendKey sends the key of a remote, a user control code, to the device by pressing and releasing it
+func (cec *Cec) SendKey(address LogicalAddress, code byte) {
+	_, source := cec.Adapter()
+	if source == DeviceUnknown {
+		log.WithFields(log.Fields{
+			"destination": address,
+			"key":         KeyName(code),
+		}).Warn("Can't send key because the address of the adapter is unknown")
+		return
+	}
+
+	cec.Transmit(NewMessage(source, address, OpcodeUserControlPressed, []byte{code}))
+	cec.Transmit(NewMessage(source, address, OpcodeUserControlRelease, []byte{}))
+}
+
+// SetStreamPath asks the TV to switch to the input of the device with the physical address, which makes it the active source
+func (cec *Cec) SetStreamPath(address PhysicalAddress) {
+	_, source := cec.Adapter()
+	if source == DeviceUnknown {
+		log.WithFields(log.Fields{
+			"physical_address": address.String(),
+		}).Warn("Can't set stream path because the address of the adapter is unknown")
+		return
+	}
+
+	cec.Transmit(NewMessage(source, DeviceBroadcast, OpcodeSetStreamPath, address[:]))
+}
+
+func (cec *Cec) GetActiveSource() LogicalAddress {
+	return cec.getBackend().GetActiveSource()
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+func init() {
+	// Runs before the state store, which registers its handlers with the router
+	RegisterInitializer(210, InitCommandRouter)
+}
+
+type DeviceMessageHandler func(device *Device, message *MqttMessage)
+
+// CommandRouter subscribes once to the set topics of all devices, and passes
+// the commands to the handler of the property. Commands on the set topic of the
+// device itself, used in JSON mode, are passed to the document handler.
+type CommandRouter struct {
+	mqtt    *Mqtt
+	devices *DeviceRegistry
+
+	handlers        map[string]DeviceMessageHandler
+	documentHandler DeviceMessageHandler
+}
+
+func InitCommandRouter(container *Container) {
+	mqtt := container.Get("mqtt").(*Mqtt)
+	config := container.Get("config").(*Config)
+
+	router := &CommandRouter{
+		mqtt:     mqtt,
+		devices:  container.Get("devices").(*DeviceRegistry),
+		handlers: make(map[string]DeviceMessageHandler),
+	}
+
+	// In JSON mode commands are sent to the device itself, otherwise to the property
+	filter := commandTopicFilter(config.Mqtt.TopicTemplate, config.Mqtt.BaseTopic)
+	topic := filter + "/+/set"
+	if config.Mqtt.StateFormat == StateFormatJson {
+		topic = filter + "/set"
+	}
+
+	log.WithFields(log.Fields{
+		"topic": topic,
+	}).Debug("Subscribing to commands")
+
+	mqtt.SubscribeMessage(topic, 0, router.route)
+
+	container.Register("command-router", router)
+}
+
+// RegisterHandler registers the handler for commands on the set topic of the property
+func (router *CommandRouter) RegisterHandler(property string, handler DeviceMessageHandler) {
+	router.handlers[property] = handler
+}
+
+// RegisterDocumentHandler registers the handler for commands on the set topic of the device
+func (router *CommandRouter) RegisterDocumentHandler(handler DeviceMessageHandler) {
+	router.documentHandler = handler
+}
+
+func (router *CommandRouter) route(message *MqttMessage) {
+	device, property := router.resolve(message.Topic)
+	if device == nil {
+		log.WithFields(log.Fields{
+			"topic": message.Topic,
+		}).Debug("Received command for unknown device")
+		return
+	}
+
+	logContext := log.WithFields(log.Fields{
+		"device.id": device.Id,
+		"property":  property,
+	})
+
+	handler := router.documentHandler
+	if property != "" {
+		handler = router.handlers[property]
+	}
+
+	if handler == nil {
+		logContext.Warn("Received command for unknown property")
+		return
+	}
+
+	logContext.Trace("Dispatching command")
+
+	handler(device, message)
+}
+
+// resolve finds the device and property, which is empty for the set topic of the device itself
+func (router *CommandRouter) resolve(topic string) (*Device, string) {
+	rest := strings.TrimSuffix(topic, "/set")
+
+	for _, device := range router.devices.List() {
+		if device.Config.Ignore {
+			continue
+		}
+
+		deviceTopic := router.mqtt.BuildDeviceTopic(device)
+		if rest == deviceTopic {
+			return device, ""
+		}
+
+		if strings.HasPrefix(rest, deviceTopic+"/") {
+			return device, strings.TrimPrefix(rest, deviceTopic+"/")
+		}
+	}
+
+	return nil, ""
+}
+
+// commandTopicFilter converts the topic template into a filter matching the topics of all devices
+func commandTopicFilter(template string, base string) string {
+	levels := strings.Split(strings.TrimSuffix(template, "/{property}"), "/")
+
+	for i, level := range levels {
+		if level == "{base}" {
+			levels[i] = base
+		} else if strings.Contains(level, "{") {
+			levels[i] = "+"
+		}
+	}
+
+	return strings.Join(levels, "/")
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCommandTopicFilter(t *testing.T) {
+	tests := []struct {
+		template string
+		base     string
+		expected string
+	}{
+		{DefaultTopicTemplate, "cec2mqtt", "cec2mqtt/+"},
+		{DefaultTopicTemplate, "home/cec2mqtt", "home/cec2mqtt/+"},
+		{"{base}/{type}/{name}/{property}", "cec2mqtt", "cec2mqtt/+/+"},
+		{"{base}/{id}/{property}", "cec2mqtt", "cec2mqtt/+"},
+		{"home/{name}/cec/{property}", "cec2mqtt", "home/+/cec"},
+		{"{base}/device-{name}/{property}", "cec2mqtt", "cec2mqtt/+"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.template, func(t *testing.T) {
+			if filter := commandTopicFilter(test.template, test.base); filter != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, filter)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	CommandAcked     = "acked"
+	CommandNacked    = "nacked"
+	CommandTimedOut  = "timed_out"
+	CommandConfirmed = "confirmed"
+	CommandInvalid   = "invalid"
+	// The command has been sent, used by the API which doesn't wait for a result
+	CommandSent = "sent"
+)
+
+// Time to wait for libcec to report a message hasn't been acknowledged
+const commandAckWindow = 500 * time.Millisecond
+
+// DeviceCommand is a command received on MQTT, or the API, to change a property of a device.
+type DeviceCommand struct {
+	Device    *Device
+	Property  string
+	Value     interface{}
+	RequestId string
+
+	request  *MqttMessage
+	received time.Time
+}
+
+// DeviceCommandHandler handles a command and returns the state the property is
+// expected to get, or nil when the state can't be confirmed.
+type DeviceCommandHandler func(command *DeviceCommand) (interface{}, error)
+
+type CommandResult struct {
+	RequestId string      `json:"request_id,omitempty"`
+	Device    string      `json:"device"`
+	Property  string      `json:"property"`
+	Value     interface{} `json:"value"`
+	Status    string      `json:"status"`
+	Error     string      `json:"error,omitempty"`
+	Latency   int64       `json:"latency_ms"`
+}
+
+type trackedCommand struct {
+	command *DeviceCommand
+	// The opcodes the command handler sends, used to recognize its transmission
+	opcodes  []Opcode
+	expected interface{}
+	// Whether the expected state is known, which is after the command has been handled
+	expecting bool
+
+	transmitted bool
+	acked       time.Time
+	timer       *time.Timer
+}
+
+// CommandTracker follows commands which have been sent to a device until these are
+// acknowledged and the device reports the expected state, and publishes the result.
+type CommandTracker struct {
+	mqtt           *Mqtt
+	confirmTimeout time.Duration
+
+	mutex    sync.Mutex
+	commands []*trackedCommand
+}
+
+func NewCommandTracker(cec *Cec, mqtt *Mqtt, config *CommandsConfig) *CommandTracker {
+	tracker := &CommandTracker{
+		mqtt:           mqtt,
+		confirmTimeout: config.ConfirmTimeout,
+		commands:       make([]*trackedCommand, 0),
+	}
+
+	cec.RegisterTransmitHandler(tracker.transmitted)
+
+	return tracker
+}
+
+// Wants checks whether a result has been requested for the command, which is
+// only possible for commands received on MQTT
+func (tracker *CommandTracker) Wants(command *DeviceCommand) bool {
+	if command.request == nil {
+		return false
+	}
+
+	return command.RequestId != "" || command.request.ResponseTopic != ""
+}
+
+// Track starts tracking the command, which is sent using one of the opcodes. It must
+// be called before the command is sent to the device, followed by either Expect or
+// Cancel once it has been sent.
+func (tracker *CommandTracker) Track(command *DeviceCommand, opcodes []Opcode) {
+	tracked := &trackedCommand{
+		command: command,
+		opcodes: opcodes,
+	}
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.commands = append(tracker.commands, tracked)
+	tracked.timer = time.AfterFunc(tracker.confirmTimeout, func() {
+		tracker.mutex.Lock()
+		defer tracker.mutex.Unlock()
+
+		if !tracker.isTracked(tracked) {
+			return
+		}
+
+		if tracked.acked.IsZero() {
+			tracker.finish(tracked, CommandTimedOut, time.Now())
+		} else {
+			tracker.finish(tracked, CommandAcked, tracked.acked)
+		}
+	})
+}
+
+// Expect sets the state the device is expected to get, which is confirmed right
+// away when the device already has this state.
+func (tracker *CommandTracker) Expect(command *DeviceCommand, expected interface{}, current interface{}) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracked := tracker.find(command)
+	if tracked == nil {
+		return
+	}
+
+	tracked.expected = expected
+	tracked.expecting = true
+
+	if expected != nil && expected == current {
+		tracker.finish(tracked, CommandConfirmed, time.Now())
+	} else if expected == nil && !tracked.acked.IsZero() {
+		tracker.finish(tracked, CommandAcked, tracked.acked)
+	}
+}
+
+// Cancel stops tracking the command without publishing a result.
+func (tracker *CommandTracker) Cancel(command *DeviceCommand) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if tracked := tracker.find(command); tracked != nil {
+		tracker.remove(tracked)
+	}
+}
+
+// Reject publishes the result of a command which couldn't be handled.
+func (tracker *CommandTracker) Reject(command *DeviceCommand, err error) {
+	tracker.publish(command, CommandInvalid, err, time.Now())
+}
+
+func (tracker *CommandTracker) transmitted(message Message, acked bool) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	for _, tracked := range tracker.commands {
+		if !tracked.sentAs(message) {
+			continue
+		}
+
+		if !acked && tracked.transmitted && tracked.acked.IsZero() {
+			tracker.finish(tracked, CommandNacked, time.Now())
+			return
+		}
+
+		if acked && !tracked.transmitted {
+			tracked.transmitted = true
+			tracker.awaitAck(tracked, time.Now())
+			return
+		}
+	}
+}
+
+// awaitAck considers the command acknowledged when libcec hasn't reported otherwise
+// in a short while. The mutex must be held by the caller.
+func (tracker *CommandTracker) awaitAck(tracked *trackedCommand, transmitted time.Time) {
+	time.AfterFunc(commandAckWindow, func() {
+		tracker.mutex.Lock()
+		defer tracker.mutex.Unlock()
+
+		if !tracker.isTracked(tracked) {
+			return
+		}
+
+		tracked.acked = transmitted
+		if tracked.expecting && tracked.expected == nil {
+			tracker.finish(tracked, CommandAcked, transmitted)
+		}
+	})
+}
+
+// StateChanged confirms the commands waiting for the device to get the state.
+func (tracker *CommandTracker) StateChanged(device *Device, property string, value interface{}) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	// Finishing a command removes it, so iterate over a copy
+	commands := append([]*trackedCommand(nil), tracker.commands...)
+	for _, tracked := range commands {
+		command := tracked.command
+		if command.Device.Id == device.Id && command.Property == property &&
+			tracked.expecting && tracked.expected != nil && tracked.expected == value {
+			tracker.finish(tracked, CommandConfirmed, time.Now())
+		}
+	}
+}
+
+// sentAs checks whether the message is the one sent for the command, so other
+// traffic to the device, like polling its power status, isn't mistaken for it
+func (tracked *trackedCommand) sentAs(message Message) bool {
+	destination := message.Destination()
+	if destination != tracked.command.Device.LogicalAddress && destination != DeviceBroadcast {
+		return false
+	}
+
+	for _, opcode := range tracked.opcodes {
+		if message.Opcode() == opcode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The functions below must be called while holding the mutex
+
+func (tracker *CommandTracker) find(command *DeviceCommand) *trackedCommand {
+	for _, tracked := range tracker.commands {
+		if tracked.command == command {
+			return tracked
+		}
+	}
+
+	return nil
+}
+
+func (tracker *CommandTracker) isTracked(tracked *trackedCommand) bool {
+	for _, existing := range tracker.commands {
+		if existing == tracked {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (tracker *CommandTracker) remove(tracked *trackedCommand) {
+	for i, existing := range tracker.commands {
+		if existing == tracked {
+			tracker.commands = append(tracker.commands[:i], tracker.commands[i+1:]...)
+			break
+		}
+	}
+
+	tracked.timer.Stop()
+}
+
+// finish stops tracking the command and publishes its result
+func (tracker *CommandTracker) finish(tracked *trackedCommand, status string, at time.Time) {
+	tracker.remove(tracked)
+
+	go tracker.publish(tracked.command, status, nil, at)
+}
+
+func (tracker *CommandTracker) publish(command *DeviceCommand, status string, err error, at time.Time) {
+	result := &CommandResult{
+		RequestId: command.RequestId,
+		Device:    command.Device.Id,
+		Property:  command.Property,
+		Value:     command.Value,
+		Status:    status,
+		Latency:   at.Sub(command.received).Milliseconds(),
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	log.WithFields(log.Fields{
+		"device.id":  command.Device.Id,
+		"property":   command.Property,
+		"request_id": command.RequestId,
+		"status":     status,
+		"latency":    at.Sub(command.received),
+	}).Debug("Publishing command result")
+
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to convert command result to JSON")
+		return
+	}
+
+	tracker.mqtt.Respond(command.request, tracker.mqtt.BuildTopic(command.Device, "response"), encoded)
+}
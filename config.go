@@ -1,32 +1,138 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
 	"strings"
+	"time"
 )
 
 type MqttConfig struct {
-	Host         string `yaml:"host"`
-	Username     string
-	Password     string
-	StateTopic   string `yaml:"state_topic"`
-	BirthMessage string `yaml:"birth_message"`
-	WillMessage  string `yaml:"will_message"`
-	BaseTopic    string `yaml:"base_topic"`
+	Host               string `yaml:"host"`
+	Username           string
+	Password           string
+	StateTopic         string        `yaml:"state_topic"`
+	BirthMessage       string        `yaml:"birth_message"`
+	WillMessage        string        `yaml:"will_message"`
+	BaseTopic          string        `yaml:"base_topic"`
+	CaFile             string        `yaml:"ca_file"`
+	CertFile           string        `yaml:"cert_file"`
+	KeyFile            string        `yaml:"key_file"`
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify"`
+	ServerName         string        `yaml:"server_name"`
+	ProtocolVersion    int           `yaml:"protocol_version"`
+	MessageExpiry      time.Duration `yaml:"message_expiry"`
+	ConnectRetries     int           `yaml:"connect_retries"`
+	MaxReconnectDelay  time.Duration `yaml:"max_reconnect_delay"`
+	PersistOutbox      bool          `yaml:"persist_outbox"`
+	QoS                *byte         `yaml:"qos,omitempty"`
+	Retain             *bool         `yaml:"retain,omitempty"`
+	StateFormat        string        `yaml:"state_format"`
+	State              TopicConfig   `yaml:"state,omitempty"`
+	Discovery          TopicConfig   `yaml:"discovery,omitempty"`
+	Events             TopicConfig   `yaml:"events,omitempty"`
+	ClientId           string        `yaml:"client_id"`
+	KeepAlive          time.Duration `yaml:"keep_alive"`
+	ConnectTimeout     time.Duration `yaml:"connect_timeout"`
+	CleanSession       *bool         `yaml:"clean_session"`
+	OrderMatters       *bool         `yaml:"order_matters"`
+	TopicTemplate      string        `yaml:"topic_template"`
+}
+
+// TopicConfig configures how a class of topics is published. Options which
+// aren't set fall back to the global MQTT options, and then to the defaults.
+type TopicConfig struct {
+	QoS    *byte `yaml:"qos,omitempty"`
+	Retain *bool `yaml:"retain,omitempty"`
 }
 
 type HomeAssistantConfig struct {
-	Enable          bool   `yaml:"enable"`
-	DiscoveryPrefix string `yaml:"discovery_prefix"`
-	BirthTopic      string `yaml:"birth_topic"`
-	BirthPayload    string `yaml:"birth_payload"`
+	Enable           bool                `yaml:"enable"`
+	DiscoveryPrefix  string              `yaml:"discovery_prefix"`
+	BirthTopic       string              `yaml:"birth_topic"`
+	BirthPayload     string              `yaml:"birth_payload"`
+	DisabledFeatures []string            `yaml:"disabled_features"`
+	TriggerKeys      []string            `yaml:"trigger_keys"`
+	Buttons          map[string][]string `yaml:"buttons"`
+	DiscoveryMode    string              `yaml:"discovery_mode"`
+}
+
+type WatchdogConfig struct {
+	CheckInterval time.Duration `yaml:"check_interval"`
+	IdleTimeout   time.Duration `yaml:"idle_timeout"`
+	MaxErrors     int           `yaml:"max_errors"`
+	MaxBackoff    time.Duration `yaml:"max_backoff"`
+}
+
+type SimulatedDeviceConfig struct {
+	LogicalAddress  int    `yaml:"logical_address"`
+	PhysicalAddress string `yaml:"physical_address"`
+	VendorId        int    `yaml:"vendor_id"`
+	OSD             string `yaml:"osd"`
+	Power           string `yaml:"power"`
+}
+
+type SimulationConfig struct {
+	Devices []SimulatedDeviceConfig `yaml:"devices"`
+}
+
+type ReplayConfig struct {
+	File  string  `yaml:"file"`
+	Speed float64 `yaml:"speed"`
+}
+
+type CecConfig struct {
+	Backend    string           `yaml:"backend"`
+	Adapter    string           `yaml:"adapter"`
+	Watchdog   WatchdogConfig   `yaml:"watchdog"`
+	Simulation SimulationConfig `yaml:"simulation"`
+	Replay     ReplayConfig     `yaml:"replay"`
+}
+
+type HomieConfig struct {
+	Enable    bool   `yaml:"enable"`
+	BaseTopic string `yaml:"base_topic"`
+}
+
+type ApiConfig struct {
+	Enable  bool   `yaml:"enable"`
+	Address string `yaml:"address"`
+	Token   string `yaml:"token,omitempty"`
+}
+
+type CommandsConfig struct {
+	ConfirmTimeout time.Duration `yaml:"confirm_timeout"`
 }
 
 type Config struct {
 	Mqtt          MqttConfig
+	Cec           CecConfig           `yaml:"cec"`
+	Commands      CommandsConfig      `yaml:"commands"`
 	HomeAssistant HomeAssistantConfig `yaml:"home_assistant"`
+	Homie         HomieConfig         `yaml:"homie"`
+	Api           ApiConfig           `yaml:"api"`
+}
+
+// PublishOptions returns the QoS and retain flag to use for a class of topics,
+// falling back to the global options and then to the given retain flag.
+func (mqttConfig *MqttConfig) PublishOptions(topicConfig *TopicConfig, retain bool) (byte, bool) {
+	var qos byte
+	if topicConfig.QoS != nil {
+		qos = *topicConfig.QoS
+	} else if mqttConfig.QoS != nil {
+		qos = *mqttConfig.QoS
+	}
+
+	if topicConfig.Retain != nil {
+		retain = *topicConfig.Retain
+	} else if mqttConfig.Retain != nil {
+		retain = *mqttConfig.Retain
+	}
+
+	return qos, retain
 }
 
 func ParseConfig(configPath string) (*Config, error) {
@@ -52,6 +158,112 @@ func ParseConfig(configPath string) (*Config, error) {
 		return nil, err
 	}
 
+	if config.Mqtt.ProtocolVersion == 0 {
+		config.Mqtt.ProtocolVersion = 4
+	}
+
+	if config.Mqtt.MaxReconnectDelay <= 0 {
+		config.Mqtt.MaxReconnectDelay = time.Minute
+	}
+
+	if config.Mqtt.KeepAlive <= 0 {
+		config.Mqtt.KeepAlive = 30 * time.Second
+	}
+
+	if config.Mqtt.ConnectTimeout <= 0 {
+		config.Mqtt.ConnectTimeout = 30 * time.Second
+	}
+
+	if config.Mqtt.CleanSession == nil {
+		cleanSession := true
+		config.Mqtt.CleanSession = &cleanSession
+	}
+
+	if config.Mqtt.OrderMatters == nil {
+		orderMatters := true
+		config.Mqtt.OrderMatters = &orderMatters
+	}
+
+	if config.Mqtt.TopicTemplate == "" {
+		config.Mqtt.TopicTemplate = DefaultTopicTemplate
+	}
+
+	if err := ValidateTopicTemplate(config.Mqtt.TopicTemplate); err != nil {
+		logContext.WithFields(log.Fields{
+			"error": err,
+		}).Error("Configuration is invalid")
+		return nil, err
+	}
+
+	switch config.Mqtt.StateFormat {
+	case "":
+		config.Mqtt.StateFormat = StateFormatTopics
+	case StateFormatTopics, StateFormatJson:
+	default:
+		err := fmt.Errorf("Invalid state format %q, must be %s or %s", config.Mqtt.StateFormat, StateFormatTopics, StateFormatJson)
+		logContext.WithFields(log.Fields{
+			"error": err,
+		}).Error("Configuration is invalid")
+		return nil, err
+	}
+
+	for name, qos := range map[string]*byte{
+		"mqtt":      config.Mqtt.QoS,
+		"state":     config.Mqtt.State.QoS,
+		"discovery": config.Mqtt.Discovery.QoS,
+		"events":    config.Mqtt.Events.QoS,
+	} {
+		if qos != nil && *qos > 2 {
+			err := fmt.Errorf("Invalid QoS %d configured for %s", *qos, name)
+			logContext.WithFields(log.Fields{
+				"error": err,
+			}).Error("Configuration is invalid")
+			return nil, err
+		}
+	}
+
+	if config.Commands.ConfirmTimeout <= 0 {
+		config.Commands.ConfirmTimeout = 30 * time.Second
+	}
+
+	if config.Cec.Backend == "" {
+		config.Cec.Backend = "libcec"
+	}
+
+	// Fail right away, the watchdog can't fix a backend which isn't available
+	if _, ok := cecBackends[config.Cec.Backend]; !ok {
+		err := fmt.Errorf("CEC backend %s does not exist", config.Cec.Backend)
+		if config.Cec.Backend == "libcec" {
+			err = errors.New("cec2mqtt has been built without libcec (using -tags nolibcec), use the simulated or replay backend instead")
+		}
+
+		logContext.WithFields(log.Fields{
+			"error": err,
+		}).Error("Configuration is invalid")
+
+		return nil, err
+	}
+
+	if config.Cec.Replay.Speed <= 0 {
+		config.Cec.Replay.Speed = 1
+	}
+
+	if config.Cec.Watchdog.CheckInterval <= 0 {
+		config.Cec.Watchdog.CheckInterval = 30 * time.Second
+	}
+
+	if config.Cec.Watchdog.IdleTimeout <= 0 {
+		config.Cec.Watchdog.IdleTimeout = 10 * time.Minute
+	}
+
+	if config.Cec.Watchdog.MaxErrors <= 0 {
+		config.Cec.Watchdog.MaxErrors = 10
+	}
+
+	if config.Cec.Watchdog.MaxBackoff <= 0 {
+		config.Cec.Watchdog.MaxBackoff = 5 * time.Minute
+	}
+
 	if config.HomeAssistant.Enable {
 		if config.HomeAssistant.DiscoveryPrefix == "" {
 			log.Debug("Home assistant integration is enabled but discovery prefix is not set. Setting default.")
@@ -60,6 +272,41 @@ func ParseConfig(configPath string) (*Config, error) {
 			strings.Trim(config.HomeAssistant.DiscoveryPrefix, "/")
 		}
 
+		switch config.HomeAssistant.DiscoveryMode {
+		case "":
+			config.HomeAssistant.DiscoveryMode = HomeAssistantDiscoveryEntity
+		case HomeAssistantDiscoveryEntity, HomeAssistantDiscoveryDevice:
+		default:
+			err := fmt.Errorf("Invalid discovery mode %q, must be %s or %s", config.HomeAssistant.DiscoveryMode, HomeAssistantDiscoveryEntity, HomeAssistantDiscoveryDevice)
+			logContext.WithFields(log.Fields{
+				"error": err,
+			}).Error("Configuration is invalid")
+			return nil, err
+		}
+
+		if config.HomeAssistant.Buttons == nil {
+			remote := []string{"root_menu", "exit", "select", "up", "down", "left", "right", "play", "pause", "contents_menu"}
+			config.HomeAssistant.Buttons = map[string][]string{
+				"tv":       remote,
+				"recorder": remote,
+				"tuner":    remote,
+				"playback": remote,
+				"audio":    {"volume_up", "volume_down", "mute"},
+			}
+		}
+
+		for deviceType, keys := range config.HomeAssistant.Buttons {
+			for _, key := range keys {
+				if _, ok := KeyCode(key); !ok {
+					err := fmt.Errorf("Unknown key %s configured as button for %s", key, deviceType)
+					logContext.WithFields(log.Fields{
+						"error": err,
+					}).Error("Configuration is invalid")
+					return nil, err
+				}
+			}
+		}
+
 		if config.HomeAssistant.BirthTopic == "" {
 			log.Debug("Home Assistant integration is enabled but birth topic is not set. Setting default.")
 			config.HomeAssistant.BirthTopic = "hass/status"
@@ -71,6 +318,26 @@ func ParseConfig(configPath string) (*Config, error) {
 		}
 	}
 
+	if config.Homie.Enable {
+		if config.Homie.BaseTopic == "" {
+			log.Debug("Homie is enabled but base topic is not set. Setting default.")
+			config.Homie.BaseTopic = "homie"
+		} else if strings.ContainsAny(config.Homie.BaseTopic, "+#") {
+			err := fmt.Errorf("Homie base topic %s can't contain wildcards", config.Homie.BaseTopic)
+			logContext.WithFields(log.Fields{
+				"error": err,
+			}).Error("Configuration is invalid")
+			return nil, err
+		}
+
+		config.Homie.BaseTopic = strings.Trim(config.Homie.BaseTopic, "/")
+	}
+
+	if config.Api.Enable && config.Api.Address == "" {
+		log.Debug("API is enabled but address is not set. Setting default.")
+		config.Api.Address = "127.0.0.1:8080"
+	}
+
 	return &config, nil
 }
 
@@ -1,24 +1,29 @@
 package main
 
 import (
-	"github.com/RobertMe/gocec"
+	"fmt"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
+	"sort"
 	"sync"
+	"time"
 )
 
 type DeviceAddedHandler func(device *Device)
+type DeviceRemovedHandler func(device *Device)
 
 type DeviceRegistry struct {
+	dataDirectory string
 	configDevices map[string]*DeviceConfig
 
-	deviceAddedHandlers []DeviceAddedHandler
+	deviceAddedHandlers   []DeviceAddedHandler
+	deviceRemovedHandlers []DeviceRemovedHandler
 
 	devicesMutex       sync.Mutex
-	devices            map[gocec.LogicalAddress]*Device
-	physicalAddressMap map[gocec.PhysicalAddress]*Device
+	devices            map[LogicalAddress]*Device
+	physicalAddressMap map[PhysicalAddress]*Device
 }
 
 type DeviceConfig struct {
@@ -28,6 +33,24 @@ type DeviceConfig struct {
 	OSD             string `yaml:"osd"`
 	MqttTopic       string `yaml:"mqtt_topic"`
 	Ignore			bool `yaml:"ignore"`
+	HomeAssistant   *HomeAssistantDeviceConfig `yaml:"home_assistant,omitempty"`
+}
+
+// HomeAssistantDeviceConfig overrides how the device and its entities are shown in Home Assistant
+type HomeAssistantDeviceConfig struct {
+	Name     string                                `yaml:"name,omitempty"`
+	Area     string                                `yaml:"area,omitempty"`
+	Disabled bool                                  `yaml:"disabled,omitempty"`
+	Hide     bool                                  `yaml:"hide,omitempty"`
+	Entities map[string]*HomeAssistantEntityConfig `yaml:"entities,omitempty"`
+}
+
+// HomeAssistantEntityConfig overrides a single entity, like power, of the device
+type HomeAssistantEntityConfig struct {
+	Name     string `yaml:"name,omitempty"`
+	Icon     string `yaml:"icon,omitempty"`
+	Disabled bool   `yaml:"disabled,omitempty"`
+	Hide     bool   `yaml:"hide,omitempty"`
 }
 
 type Device struct {
@@ -36,18 +59,71 @@ type Device struct {
 	CecDevice *CecDeviceDescription
 	Config    *DeviceConfig
 
-	LogicalAddress gocec.LogicalAddress
+	LogicalAddress LogicalAddress
+
+	lastSeenMutex sync.Mutex
+	lastSeen      time.Time
+
+	featuresMutex sync.Mutex
+	features      []string
 }
 
 type CreateCecDeviceDescription func() *CecDeviceDescription
 
 func NewDeviceRegistry(dataDirectory string) *DeviceRegistry {
-	return &DeviceRegistry{
-		configDevices:       loadDevicesFromConfig(dataDirectory),
-		deviceAddedHandlers: make([]DeviceAddedHandler, 0),
-		devices:             make(map[gocec.LogicalAddress]*Device),
-		physicalAddressMap:  make(map[gocec.PhysicalAddress]*Device),
+	registry := &DeviceRegistry{
+		dataDirectory:         dataDirectory,
+		configDevices:         loadDevicesFromConfig(dataDirectory),
+		deviceAddedHandlers:   make([]DeviceAddedHandler, 0),
+		deviceRemovedHandlers: make([]DeviceRemovedHandler, 0),
+		devices:               make(map[LogicalAddress]*Device),
+		physicalAddressMap:    make(map[PhysicalAddress]*Device),
+	}
+
+	if registry.migrateTopics() {
+		registry.Save(dataDirectory)
+	}
+
+	return registry
+}
+
+// migrateTopics replaces topics which are invalid or used by multiple devices, as
+// these were accepted by older versions. Returns whether any topic has been changed.
+func (registry *DeviceRegistry) migrateTopics() bool {
+	ids := make([]string, 0, len(registry.configDevices))
+	for id := range registry.configDevices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	migrated := false
+	for _, id := range ids {
+		device := registry.configDevices[id]
+		err := registry.validateTopic(device, device.MqttTopic)
+		if err == nil {
+			continue
+		}
+
+		name := device.MqttTopic
+		if name == "" {
+			name = device.OSD
+		}
+
+		oldTopic := device.MqttTopic
+		// The device mustn't conflict with its own topic
+		device.MqttTopic = ""
+		device.MqttTopic = registry.uniqueTopic(SlugifyTopic(name))
+		migrated = true
+
+		log.WithFields(log.Fields{
+			"device.id": device.Id,
+			"old_topic": oldTopic,
+			"new_topic": device.MqttTopic,
+			"error":     err,
+		}).Warn("Changing invalid topic of device")
 	}
+
+	return migrated
 }
 
 func loadDevicesFromConfig(dataDirectory string) (devices map[string]*DeviceConfig) {
@@ -79,7 +155,14 @@ func (registry *DeviceRegistry) RegisterDeviceAddedHandler(handler DeviceAddedHa
 	registry.deviceAddedHandlers = append(registry.deviceAddedHandlers, handler)
 }
 
-func (registry *DeviceRegistry) FindByLogicalAddress(address gocec.LogicalAddress) *Device {
+// RegisterDeviceRemovedHandler registers a handler which is called when a device is
+// ignored, removed or about to be renamed, so anything published for the device can be cleaned up.
+func (registry *DeviceRegistry) RegisterDeviceRemovedHandler(handler DeviceRemovedHandler) {
+	log.Trace("Registering device removed handler")
+	registry.deviceRemovedHandlers = append(registry.deviceRemovedHandlers, handler)
+}
+
+func (registry *DeviceRegistry) FindByLogicalAddress(address LogicalAddress) *Device {
 	logContext := log.WithFields(log.Fields{
 		"logical_address": address,
 	})
@@ -104,7 +187,7 @@ func (registry *DeviceRegistry) FindByLogicalAddress(address gocec.LogicalAddres
 	return device
 }
 
-func (registry *DeviceRegistry) GetByCecDevice(address gocec.LogicalAddress, creator CreateCecDeviceDescription) *Device {
+func (registry *DeviceRegistry) GetByCecDevice(address LogicalAddress, creator CreateCecDeviceDescription) *Device {
 	registry.devicesMutex.Lock()
 
 	logContext := log.WithFields(log.Fields{
@@ -132,7 +215,7 @@ func (registry *DeviceRegistry) GetByCecDevice(address gocec.LogicalAddress, cre
 	description := creator()
 
 	if description.physicalAddress == [2]byte{0xFF, 0xFF} ||
-		description.vendor == gocec.VendorUnknown ||
+		description.vendor == VendorUnknown ||
 		description.OSD == "cec2mqtt" {
 		registry.devicesMutex.Unlock()
 		logContext.WithFields(log.Fields{
@@ -194,14 +277,15 @@ func (registry *DeviceRegistry) GetByCecDevice(address gocec.LogicalAddress, cre
 	if deviceConfig.Ignore {
 		logContext.Debug("Added new device, but not registering it as it's ignored")
 
+		// States may still be retained from before the device was ignored
+		registry.callRemovedHandlers(device)
+
 		return nil
 	}
 
 	logContext.Debug("Adding new device")
 
-	for _, handler := range registry.deviceAddedHandlers {
-		handler(device)
-	}
+	registry.callAddedHandlers(device)
 
 	return device
 }
@@ -280,7 +364,7 @@ func (registry *DeviceRegistry) FindDevice(physicalAddress string, vendorId int,
 		PhysicalAddress: physicalAddress,
 		VendorId:        vendorId,
 		OSD:             name,
-		MqttTopic:       name,
+		MqttTopic:       registry.uniqueTopic(SlugifyTopic(name)),
 	}
 
 	log.WithFields(log.Fields{
@@ -297,7 +381,9 @@ func (registry *DeviceRegistry) FindDevice(physicalAddress string, vendorId int,
 }
 
 func (registry *DeviceRegistry) Save(configPath string) error {
+	registry.devicesMutex.Lock()
 	data, err := yaml.Marshal(registry.configDevices)
+	registry.devicesMutex.Unlock()
 
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -319,6 +405,237 @@ func (registry *DeviceRegistry) Save(configPath string) error {
 	return nil
 }
 
+// Find looks up a device by its id or MQTT topic. Besides the device itself, when
+// it has been seen, the configuration is returned so devices which haven't been
+// seen yet can be managed as well.
+func (registry *DeviceRegistry) Find(identifier string) (*DeviceConfig, *Device) {
+	registry.devicesMutex.Lock()
+	defer registry.devicesMutex.Unlock()
+
+	var config *DeviceConfig
+	if found, ok := registry.configDevices[identifier]; ok {
+		config = found
+	} else {
+		for _, found := range registry.configDevices {
+			if found.MqttTopic == identifier {
+				config = found
+				break
+			}
+		}
+	}
+
+	if config == nil {
+		return nil, nil
+	}
+
+	for _, device := range registry.devices {
+		if device.Config == config {
+			return config, device
+		}
+	}
+
+	return config, nil
+}
+
+// Rename changes the MQTT topic of the device. When the device is active it's
+// removed and added again, so everything is moved to the new topic.
+func (registry *DeviceRegistry) Rename(config *DeviceConfig, device *Device, topic string) error {
+	registry.devicesMutex.Lock()
+	err := registry.validateTopic(config, topic)
+	registry.devicesMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"device.id": config.Id,
+		"from":      config.MqttTopic,
+		"to":        topic,
+	}).Info("Renaming device")
+
+	active := device != nil && !config.Ignore
+	if active {
+		registry.callRemovedHandlers(device)
+	}
+
+	// The topic is validated again while assigning it, as a new device may have taken it in the meantime
+	registry.devicesMutex.Lock()
+	err = registry.validateTopic(config, topic)
+	if err == nil {
+		config.MqttTopic = topic
+	}
+	registry.devicesMutex.Unlock()
+
+	if active {
+		registry.callAddedHandlers(device)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return registry.Save(registry.dataDirectory)
+}
+
+// Ignore ignores the device, after which its states aren't published anymore
+func (registry *DeviceRegistry) Ignore(config *DeviceConfig, device *Device) error {
+	registry.devicesMutex.Lock()
+	ignored := config.Ignore
+	config.Ignore = true
+	registry.devicesMutex.Unlock()
+
+	if ignored {
+		return fmt.Errorf("The device %s is already ignored", config.Id)
+	}
+
+	log.WithFields(log.Fields{
+		"device.id": config.Id,
+	}).Info("Ignoring device")
+
+	if device != nil {
+		registry.callRemovedHandlers(device)
+	}
+
+	return registry.Save(registry.dataDirectory)
+}
+
+// Unignore stops ignoring the device, adding it again when it has been seen
+func (registry *DeviceRegistry) Unignore(config *DeviceConfig, device *Device) error {
+	registry.devicesMutex.Lock()
+	ignored := config.Ignore
+	config.Ignore = false
+	registry.devicesMutex.Unlock()
+
+	if !ignored {
+		return fmt.Errorf("The device %s isn't ignored", config.Id)
+	}
+
+	log.WithFields(log.Fields{
+		"device.id": config.Id,
+	}).Info("No longer ignoring device")
+
+	if device != nil {
+		registry.callAddedHandlers(device)
+	}
+
+	return registry.Save(registry.dataDirectory)
+}
+
+// Remove forgets the device. When it still is connected it will be found again
+// as a new device.
+func (registry *DeviceRegistry) Remove(config *DeviceConfig, device *Device) error {
+	log.WithFields(log.Fields{
+		"device.id": config.Id,
+	}).Info("Removing device")
+
+	registry.devicesMutex.Lock()
+	delete(registry.configDevices, config.Id)
+	if device != nil {
+		for address, existing := range registry.devices {
+			if existing == device {
+				delete(registry.devices, address)
+			}
+		}
+		for address, existing := range registry.physicalAddressMap {
+			if existing == device {
+				delete(registry.physicalAddressMap, address)
+			}
+		}
+	}
+	registry.devicesMutex.Unlock()
+
+	if device != nil && !config.Ignore {
+		registry.callRemovedHandlers(device)
+	}
+
+	return registry.Save(registry.dataDirectory)
+}
+
+// validateTopic checks whether the device can use the topic, the mutex must be held by the caller
+func (registry *DeviceRegistry) validateTopic(config *DeviceConfig, topic string) error {
+	if err := ValidateTopicName(topic); err != nil {
+		return err
+	}
+
+	for _, existing := range registry.configDevices {
+		if existing != config && existing.MqttTopic == topic {
+			return fmt.Errorf("The topic %s is already used by device %s", topic, existing.Id)
+		}
+	}
+
+	return nil
+}
+
+// uniqueTopic appends a number to the topic when it's already in use, the mutex must be held by the caller
+func (registry *DeviceRegistry) uniqueTopic(topic string) string {
+	unique := topic
+	for i := 2; registry.validateTopic(nil, unique) != nil; i++ {
+		unique = fmt.Sprintf("%s_%d", topic, i)
+	}
+
+	return unique
+}
+
+func (registry *DeviceRegistry) callAddedHandlers(device *Device) {
+	for _, handler := range registry.deviceAddedHandlers {
+		handler(device)
+	}
+}
+
+func (registry *DeviceRegistry) callRemovedHandlers(device *Device) {
+	for _, handler := range registry.deviceRemovedHandlers {
+		handler(device)
+	}
+}
+
+// AddFeature registers a feature, like power, supported by the device
+func (device *Device) AddFeature(feature string) {
+	device.featuresMutex.Lock()
+	defer device.featuresMutex.Unlock()
+
+	for _, existing := range device.features {
+		if existing == feature {
+			return
+		}
+	}
+
+	device.features = append(device.features, feature)
+}
+
+func (device *Device) Features() []string {
+	device.featuresMutex.Lock()
+	defer device.featuresMutex.Unlock()
+
+	return append([]string{}, device.features...)
+}
+
+// Seen marks the device as seen, because a message has been received from it
+func (device *Device) Seen() {
+	device.lastSeenMutex.Lock()
+	device.lastSeen = time.Now()
+	device.lastSeenMutex.Unlock()
+}
+
+func (device *Device) LastSeen() time.Time {
+	device.lastSeenMutex.Lock()
+	defer device.lastSeenMutex.Unlock()
+
+	return device.lastSeen
+}
+
+// ListConfigs returns the configurations of all known devices, including those which haven't been seen yet
+func (registry *DeviceRegistry) ListConfigs() []*DeviceConfig {
+	registry.devicesMutex.Lock()
+	defer registry.devicesMutex.Unlock()
+
+	configs := make([]*DeviceConfig, 0, len(registry.configDevices))
+	for _, config := range registry.configDevices {
+		configs = append(configs, config)
+	}
+	return configs
+}
+
 func (registry *DeviceRegistry) List() []*Device {
 	registry.devicesMutex.Lock()
 	defer registry.devicesMutex.Unlock()
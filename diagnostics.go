@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterInitializer(0, InitDiagnosticsBridge)
+}
+
+// The last seen state is published at most this often, as it changes with every message
+const lastSeenInterval = time.Minute
+
+var diagnosticProperties = []string{
+	"physical_address",
+	"logical_address",
+	"vendor",
+	"cec_version",
+	"device_type",
+	"power_status",
+	"last_seen",
+}
+
+// DiagnosticsBridge publishes information about the devices, like the addresses,
+// vendor and CEC version, which isn't controllable but helps with debugging.
+type DiagnosticsBridge struct {
+	cec      *Cec
+	devices  *DeviceRegistry
+	state    *DeviceStateStore
+	haBridge *HomeAssistantBridge
+
+	lastSeenMutex sync.Mutex
+	lastSeen      map[string]time.Time
+}
+
+func InitDiagnosticsBridge(container *Container) {
+	cec := container.Get("cec").(*Cec)
+	mqtt := container.Get("mqtt").(*Mqtt)
+	devices := container.Get("devices").(*DeviceRegistry)
+	state := container.Get("state").(*DeviceStateStore)
+
+	bridge := &DiagnosticsBridge{
+		cec:      cec,
+		devices:  devices,
+		state:    state,
+		lastSeen: make(map[string]time.Time),
+	}
+
+	for _, property := range diagnosticProperties {
+		state.RegisterProperty(property)
+	}
+
+	devices.RegisterDeviceAddedHandler(func(device *Device) {
+		device.AddFeature("diagnostics")
+
+		go func() {
+			bridge.publish(device)
+			bridge.requestCecVersion(device)
+		}()
+	})
+
+	devices.RegisterDeviceRemovedHandler(func(device *Device) {
+		bridge.lastSeenMutex.Lock()
+		delete(bridge.lastSeen, device.Id)
+		bridge.lastSeenMutex.Unlock()
+	})
+
+	if haBridge, ok := container.Get("home-assistant").(*HomeAssistantBridge); ok {
+		log.Info("Enabling Home Assistant configuration for diagnostics")
+		bridge.haBridge = haBridge
+		devices.RegisterDeviceAddedHandler(bridge.registerSensors)
+		haBridge.RegisterBirthHandler(bridge.resendAll)
+	}
+
+	cec.RegisterMessageHandler(func(message Message) {
+		device := devices.FindByLogicalAddress(message.Source())
+		if device == nil || len(message.Parameters()) < 1 {
+			return
+		}
+
+		version := CecVersionName(message.Parameters()[0])
+
+		log.WithFields(log.Fields{
+			"device.id": device.Id,
+			"version":   version,
+		}).Debug("Received CEC version")
+
+		state.Set(device, "cec_version", version)
+	}, OpcodeCecVersion)
+
+	cec.RegisterReconnectedHandler(func() {
+		for _, device := range devices.List() {
+			if device.Config.Ignore {
+				continue
+			}
+
+			bridge.requestCecVersion(device)
+		}
+	})
+
+	mqtt.RegisterConnectedHandler(func() {
+		for _, device := range devices.List() {
+			if device.Config.Ignore {
+				continue
+			}
+
+			bridge.publish(device)
+		}
+	})
+
+	go bridge.run()
+}
+
+func (bridge *DiagnosticsBridge) run() {
+	ticker := time.NewTicker(lastSeenInterval)
+
+	for range ticker.C {
+		for _, device := range bridge.devices.List() {
+			if device.Config.Ignore {
+				continue
+			}
+
+			bridge.publishLastSeen(device)
+		}
+	}
+}
+
+// publish publishes the diagnostic states which are known from the CEC device description
+func (bridge *DiagnosticsBridge) publish(device *Device) {
+	bridge.state.Set(device, "physical_address", device.CecDevice.physicalAddress.String())
+	bridge.state.Set(device, "logical_address", int(device.LogicalAddress))
+	bridge.state.Set(device, "vendor", device.CecDevice.vendor.String())
+	bridge.state.Set(device, "device_type", DeviceType(device.LogicalAddress))
+
+	bridge.lastSeenMutex.Lock()
+	delete(bridge.lastSeen, device.Id)
+	bridge.lastSeenMutex.Unlock()
+
+	bridge.publishLastSeen(device)
+}
+
+func (bridge *DiagnosticsBridge) publishLastSeen(device *Device) {
+	lastSeen := device.LastSeen()
+	if lastSeen.IsZero() {
+		return
+	}
+
+	bridge.lastSeenMutex.Lock()
+	published := bridge.lastSeen[device.Id]
+	bridge.lastSeen[device.Id] = lastSeen
+	bridge.lastSeenMutex.Unlock()
+
+	if published.Equal(lastSeen) {
+		return
+	}
+
+	bridge.state.Set(device, "last_seen", lastSeen.Format(time.RFC3339))
+}
+
+func (bridge *DiagnosticsBridge) requestCecVersion(device *Device) {
+	_, source := bridge.cec.Adapter()
+	if source == DeviceUnknown {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"device.id": device.Id,
+	}).Trace("Requesting CEC version")
+
+	bridge.cec.Transmit(NewMessage(source, device.LogicalAddress, OpcodeGetCecVersion, []byte{}))
+}
+
+func (bridge *DiagnosticsBridge) registerSensors(device *Device) {
+	for _, property := range diagnosticProperties {
+		bridge.haBridge.RegisterDiagnosticSensor(device, property)
+	}
+}
+
+func (bridge *DiagnosticsBridge) resendAll() {
+	log.Debug("Resending all diagnostic sensors")
+
+	for _, device := range bridge.devices.List() {
+		if device.Config.Ignore {
+			continue
+		}
+
+		bridge.registerSensors(device)
+	}
+}
+
+// CecVersionName returns the version of the CEC specification, as reported by a device
+func CecVersionName(version byte) string {
+	switch version {
+	case 0x00:
+		return "1.1"
+	case 0x01:
+		return "1.2"
+	case 0x02:
+		return "1.2a"
+	case 0x03:
+		return "1.3"
+	case 0x04:
+		return "1.3a"
+	case 0x05:
+		return "1.4"
+	case 0x06:
+		return "2.0"
+	default:
+		return fmt.Sprintf("unknown (%d)", version)
+	}
+}
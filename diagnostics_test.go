@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCecVersionName(t *testing.T) {
+	tests := []struct {
+		version  byte
+		expected string
+	}{
+		{0x00, "1.1"},
+		{0x02, "1.2a"},
+		{0x04, "1.3a"},
+		{0x05, "1.4"},
+		{0x06, "2.0"},
+		{0x07, "unknown (7)"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expected, func(t *testing.T) {
+			if name := CecVersionName(test.version); name != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, name)
+			}
+		})
+	}
+}
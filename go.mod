@@ -4,6 +4,7 @@ go 1.17
 
 require (
 	github.com/RobertMe/gocec v0.0.0-20190929173718-9c11b45834db
+	github.com/eclipse/paho.golang v0.10.0
 	github.com/eclipse/paho.mqtt.golang v1.3.5
 	github.com/google/uuid v1.3.0
 	github.com/sirupsen/logrus v1.8.1
@@ -13,5 +14,6 @@ require (
 require (
 	github.com/gorilla/websocket v1.4.2 // indirect
 	golang.org/x/net v0.0.0-20200425230154-ff2c4b7c35a0 // indirect
+	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a // indirect
 	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd // indirect
 )
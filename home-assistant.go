@@ -5,19 +5,93 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"strings"
+	"sync"
+	"time"
 )
 
 func init() {
 	RegisterInitializer(100, InitHomeAssistantBridge)
 }
 
+// Time to wait for the retained discovery configurations before removing the orphans
+const homeAssistantSweepDelay = 10 * time.Second
+
+// In device mode the entities registered within this time are published together
+const homeAssistantDeviceDelay = 500 * time.Millisecond
+
+const (
+	// HomeAssistantDiscoveryEntity publishes a discovery configuration per entity
+	HomeAssistantDiscoveryEntity = "entity"
+	// HomeAssistantDiscoveryDevice publishes a single discovery configuration per device, containing all its entities
+	HomeAssistantDiscoveryDevice = "device"
+)
+
 type HomeAssistantBirthHandler func()
 
+// homeAssistantEntity contains the defaults of an entity, following the conventions of Home Assistant
+type homeAssistantEntity struct {
+	name           string
+	icon           string
+	deviceClass    string
+	entityCategory string
+	disabled       bool
+}
+
+var homeAssistantEntities = map[string]homeAssistantEntity{
+	"power":            {name: "Power", deviceClass: "switch", icon: "mdi:power"},
+	"is_active_source": {name: "Active source", icon: "mdi:import"},
+	"physical_address": {name: "Physical address", icon: "mdi:ethernet", entityCategory: "diagnostic", disabled: true},
+	"logical_address":  {name: "Logical address", icon: "mdi:numeric", entityCategory: "diagnostic", disabled: true},
+	"vendor":           {name: "Vendor", icon: "mdi:factory", entityCategory: "diagnostic", disabled: true},
+	"cec_version":      {name: "CEC version", icon: "mdi:information-outline", entityCategory: "diagnostic", disabled: true},
+	"device_type":      {name: "Device type", icon: "mdi:devices", entityCategory: "diagnostic", disabled: true},
+	"power_status":     {name: "Power status", icon: "mdi:power-settings", entityCategory: "diagnostic", disabled: true},
+	"last_seen":        {name: "Last seen", deviceClass: "timestamp", entityCategory: "diagnostic", disabled: true},
+}
+
+// The icon of the power switch, per type of device
+var homeAssistantPowerIcons = map[string]string{
+	"tv":       "mdi:television",
+	"recorder": "mdi:record-rec",
+	"tuner":    "mdi:set-top-box",
+	"playback": "mdi:play-box-outline",
+	"audio":    "mdi:speaker",
+}
+
+var homeAssistantButtonIcons = map[string]string{
+	"up":            "mdi:arrow-up-bold",
+	"down":          "mdi:arrow-down-bold",
+	"left":          "mdi:arrow-left-bold",
+	"right":         "mdi:arrow-right-bold",
+	"select":        "mdi:checkbox-blank-circle-outline",
+	"exit":          "mdi:exit-to-app",
+	"root_menu":     "mdi:home",
+	"contents_menu": "mdi:menu",
+	"play":          "mdi:play",
+	"pause":         "mdi:pause",
+	"volume_up":     "mdi:volume-plus",
+	"volume_down":   "mdi:volume-minus",
+	"mute":          "mdi:volume-mute",
+}
+
 type HomeAssistantBridge struct {
 	discoveryPrefix string
 	mqtt            *Mqtt
+	devices         *DeviceRegistry
 	config          *Config
 	birthHandlers   []HomeAssistantBirthHandler
+
+	// The discovery topics published per device
+	topicsMutex sync.Mutex
+	topics      map[string]map[string]bool
+
+	// In device mode the entities, and the device they belong to, per device
+	componentsMutex  sync.Mutex
+	components       map[string]map[string]map[string]interface{}
+	componentDevices map[string]interface{}
+	componentTimers  map[string]*time.Timer
+	// Incremented when a device is unregistered, to detect it happened while publishing
+	generations map[string]int
 }
 
 func InitHomeAssistantBridge(container *Container) {
@@ -29,12 +103,21 @@ func InitHomeAssistantBridge(container *Container) {
 
 	mqtt := container.Get("mqtt").(*Mqtt)
 	bridge := &HomeAssistantBridge{
-		discoveryPrefix: config.HomeAssistant.DiscoveryPrefix,
-		mqtt:            mqtt,
-		config:          config,
-		birthHandlers:   make([]HomeAssistantBirthHandler, 0),
+		discoveryPrefix:  config.HomeAssistant.DiscoveryPrefix,
+		mqtt:             mqtt,
+		devices:          container.Get("devices").(*DeviceRegistry),
+		config:           config,
+		birthHandlers:    make([]HomeAssistantBirthHandler, 0),
+		topics:           make(map[string]map[string]bool),
+		components:       make(map[string]map[string]map[string]interface{}),
+		componentDevices: make(map[string]interface{}),
+		componentTimers:  make(map[string]*time.Timer),
+		generations:      make(map[string]int),
 	}
 
+	bridge.devices.RegisterDeviceRemovedHandler(bridge.Unregister)
+	bridge.RegisterBirthHandler(bridge.registerBridge)
+
 	mqtt.Subscribe(config.HomeAssistant.BirthTopic, 0, func (payload []byte) {
 		log.WithFields(log.Fields{
 			"payload": string(payload),
@@ -42,12 +125,13 @@ func InitHomeAssistantBridge(container *Container) {
 
 		if string(payload) == config.HomeAssistant.BirthPayload {
 			log.Info("Received Home Assistant birth message")
-			for _, handler := range bridge.birthHandlers {
-				handler()
-			}
+			bridge.Rediscover()
 		}
 	})
 
+	bridge.registerBridge()
+	bridge.sweepOrphans()
+
 	container.Register("home-assistant", bridge)
 }
 
@@ -55,70 +139,613 @@ func (bridge *HomeAssistantBridge) RegisterBirthHandler(handler HomeAssistantBir
 	bridge.birthHandlers = append(bridge.birthHandlers, handler)
 }
 
-func (bridge *HomeAssistantBridge) RegisterSwitch(device *Device, property string) {
-	topic := strings.Builder{}
-	fmt.Fprintf(&topic, "%s/switch/%s/%s/config", bridge.discoveryPrefix, device.Id, property)
-
-	config := bridge.createConfig(device, property)
-	config["command_topic"] = bridge.mqtt.BuildTopic(device, property+"/set")
-	config["payload_on"] = "on"
-	config["payload_off"] = "off"
+// Rediscover sends the configuration of all entities to Home Assistant again
+func (bridge *HomeAssistantBridge) Rediscover() {
+	for _, handler := range bridge.birthHandlers {
+		handler()
+	}
+}
 
-	encoded, err := json.Marshal(config)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"device.id": device.Config.Id,
-			"property":  property,
-			"config":    config,
-			"error":     err,
-		}).Error("Failed to convert switch configuration to JSON")
+func (bridge *HomeAssistantBridge) RegisterSwitch(device *Device, property string) {
+	if bridge.isDisabled(property) {
+		return
+	}
 
+	config, ok := bridge.createConfig(device, property)
+	if !ok {
 		return
 	}
 
+	if bridge.config.Mqtt.StateFormat == StateFormatJson {
+		config["command_topic"] = bridge.mqtt.BuildTopic(device, "set")
+		config["command_template"] = fmt.Sprintf(`{"%s": "{{ value }}"}`, property)
+	} else {
+		config["command_topic"] = bridge.mqtt.BuildTopic(device, property+"/set")
+	}
+	config["payload_on"] = "on"
+	config["payload_off"] = "off"
+
 	log.WithFields(log.Fields{
 		"device.id": device.Config.Id,
 		"property":  property,
-		"config":    string(encoded),
+		"config":    config,
 	}).Info("Registering switch in Home Assistant")
 
-	bridge.mqtt.Publish(topic.String(), 0, true, encoded)
+	bridge.publishDiscovery(device.Id, "switch", property, config)
 }
 
 func (bridge *HomeAssistantBridge) RegisterBinarySensor(device *Device, property string) {
-	topic := strings.Builder{}
-	fmt.Fprintf(&topic, "%s/binary_sensor/%s/%s/config", bridge.discoveryPrefix, device.Id, property)
+	if bridge.isDisabled(property) {
+		return
+	}
+
+	config, ok := bridge.createConfig(device, property)
+	if !ok {
+		return
+	}
 
-	config := bridge.createConfig(device, property)
 	config["payload_on"] = "on"
 	config["payload_off"] = "off"
 
-	encoded, err := json.Marshal(config)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"device.id": device.Config.Id,
-			"property":  property,
-			"config":    config,
-			"error":     err,
-		}).Error("Failed to convert binary sensor configuration to JSON")
+	log.WithFields(log.Fields{
+		"device.id": device.Config.Id,
+		"property":  property,
+		"config":    config,
+	}).Info("Registering binary switch in Home Assistant")
+
+	bridge.publishDiscovery(device.Id, "binary_sensor", property, config)
+}
+
+// RegisterDiagnosticSensor registers a sensor for diagnostic information, like the
+// physical address. These are disabled by default in Home Assistant.
+func (bridge *HomeAssistantBridge) RegisterDiagnosticSensor(device *Device, property string) {
+	if bridge.isDisabled("diagnostics") {
+		return
+	}
 
+	config, ok := bridge.createConfig(device, property)
+	if !ok {
 		return
 	}
 
 	log.WithFields(log.Fields{
 		"device.id": device.Config.Id,
 		"property":  property,
-		"config":    string(encoded),
-	}).Info("Registering binary switch in Home Assistant")
+	}).Debug("Registering diagnostic sensor in Home Assistant")
+
+	bridge.publishDiscovery(device.Id, "sensor", property, config)
+}
+
+// RegisterTrigger registers a device trigger, like button_short_press of the red key,
+// which fires when the event is published to the key topic of the device.
+func (bridge *HomeAssistantBridge) RegisterTrigger(device *Device, triggerType string, subtype string) {
+	if bridge.isDisabled("keys") || bridge.isHidden(device, "") {
+		return
+	}
+
+	config := map[string]interface{}{
+		"automation_type": "trigger",
+		"topic":           bridge.mqtt.BuildTopic(device, "key"),
+		"type":            triggerType,
+		"subtype":         subtype,
+		"payload":         subtype + "_" + triggerType,
+		"value_template":  "{{ value_json.key }}_{{ value_json.type }}",
+		"device":          bridge.createDeviceConfig(device),
+	}
+
+	log.WithFields(log.Fields{
+		"device.id": device.Config.Id,
+		"type":      triggerType,
+		"subtype":   subtype,
+	}).Debug("Registering trigger in Home Assistant")
+
+	bridge.publishDiscovery(device.Id, "device_automation", subtype+"_"+triggerType, config)
+}
+
+// RegisterButton registers a button which sends the key of a remote to the device
+func (bridge *HomeAssistantBridge) RegisterButton(device *Device, key string) {
+	if bridge.isDisabled("buttons") {
+		return
+	}
+
+	config, ok := bridge.createEntityConfig(device, "key_"+key, homeAssistantEntity{
+		name: strings.Title(strings.ReplaceAll(key, "_", " ")),
+		icon: homeAssistantButtonIcons[key],
+	})
+	if !ok {
+		return
+	}
+
+	config["command_topic"] = bridge.mqtt.BuildTopic(device, "key/set")
+	config["payload_press"] = key
+	if bridge.config.Mqtt.StateFormat == StateFormatJson {
+		config["command_topic"] = bridge.mqtt.BuildTopic(device, "set")
+		config["payload_press"] = fmt.Sprintf(`{"key": "%s"}`, key)
+	}
+
+	log.WithFields(log.Fields{
+		"device.id": device.Config.Id,
+		"key":       key,
+	}).Debug("Registering button in Home Assistant")
+
+	bridge.publishDiscovery(device.Id, "button", "key_"+key, config)
+}
+
+// registerBridge registers cec2mqtt itself as a device, with entities for its health and to control it
+func (bridge *HomeAssistantBridge) registerBridge() {
+	info := bridge.mqtt.BuildBridgeTopic("info")
+	statistic := func(name string, icon string, key string) map[string]interface{} {
+		return map[string]interface{}{
+			"name":            name,
+			"icon":            icon,
+			"entity_category": "diagnostic",
+			"state_class":     "total_increasing",
+			"state_topic":     info,
+			"value_template":  "{{ value_json.stats." + key + " }}",
+		}
+	}
+	button := func(name string, icon string, action string) map[string]interface{} {
+		return map[string]interface{}{
+			"name":            name,
+			"icon":            icon,
+			"entity_category": "config",
+			"command_topic":   bridge.mqtt.BuildBridgeTopic("request/" + action),
+			"payload_press":   "{}",
+		}
+	}
+
+	entities := map[string]map[string]interface{}{
+		"binary_sensor/adapter": {
+			"name":            "CEC adapter",
+			"device_class":    "connectivity",
+			"entity_category": "diagnostic",
+			"state_topic":     bridge.mqtt.BuildBridgeTopic("health"),
+			"payload_on":      "online",
+			"payload_off":     "offline",
+		},
+		"sensor/uptime": {
+			"name":                "Uptime",
+			"device_class":        "duration",
+			"unit_of_measurement": "s",
+			"entity_category":     "diagnostic",
+			"state_topic":         info,
+			"value_template":      "{{ value_json.uptime }}",
+		},
+		"sensor/messages_received":    statistic("Messages received", "mdi:message-arrow-left", "messages_received"),
+		"sensor/messages_transmitted": statistic("Messages transmitted", "mdi:message-arrow-right", "messages_transmitted"),
+		"sensor/errors":               statistic("Errors", "mdi:alert-circle-outline", "errors"),
+		"button/rescan":               button("Rescan bus", "mdi:magnify-scan", "cec/rescan"),
+		"button/resend_discovery":     button("Resend discovery", "mdi:home-assistant", "home_assistant/discovery"),
+		"button/restart_cec":          button("Restart CEC connection", "mdi:restart", "cec/restart"),
+	}
+	entities["button/restart_cec"]["device_class"] = "restart"
+
+	nodeId := bridge.bridgeNodeId()
+	for entity, config := range entities {
+		levels := strings.SplitN(entity, "/", 2)
+		component, object := levels[0], levels[1]
+
+		config["has_entity_name"] = true
+		config["unique_id"] = "bridge_" + object + "_" + bridge.config.Mqtt.BaseTopic
+		config["device"] = bridge.createBridgeDeviceConfig()
+		if bridge.config.Mqtt.StateTopic != "" {
+			config["availability_topic"] = bridge.config.Mqtt.StateTopic
+			config["payload_available"] = bridge.config.Mqtt.BirthMessage
+			config["payload_not_available"] = bridge.config.Mqtt.WillMessage
+		}
+
+		bridge.publishDiscovery(nodeId, component, object, config)
+	}
+
+	log.Debug("Registered bridge in Home Assistant")
+}
+
+// bridgeNodeId is used in the discovery topics of the bridge, so multiple instances don't overwrite each other
+func (bridge *HomeAssistantBridge) bridgeNodeId() string {
+	return "bridge_" + SlugifyTopic(bridge.config.Mqtt.BaseTopic)
+}
+
+func (bridge *HomeAssistantBridge) createBridgeDeviceConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"identifiers":  []string{"cec2mqtt_bridge_" + bridge.config.Mqtt.BaseTopic},
+		"name":         "Cec2Mqtt (" + bridge.config.Mqtt.BaseTopic + ")",
+		"sw_version":   "Cec2Mqtt " + BuildVersion,
+		"manufacturer": "Cec2Mqtt",
+		"model":        "Bridge",
+	}
+}
+
+// Unregister removes all entities of the device from Home Assistant
+func (bridge *HomeAssistantBridge) Unregister(device *Device) {
+	bridge.componentsMutex.Lock()
+	if timer, ok := bridge.componentTimers[device.Id]; ok {
+		timer.Stop()
+		delete(bridge.componentTimers, device.Id)
+	}
+	delete(bridge.components, device.Id)
+	delete(bridge.componentDevices, device.Id)
+	bridge.generations[device.Id]++
+	bridge.componentsMutex.Unlock()
+
+	bridge.topicsMutex.Lock()
+	topics := bridge.topics[device.Id]
+	delete(bridge.topics, device.Id)
+	bridge.topicsMutex.Unlock()
+
+	for topic := range topics {
+		log.WithFields(log.Fields{
+			"device.id": device.Id,
+			"topic":     topic,
+		}).Info("Removing entity from Home Assistant")
+
+		bridge.mqtt.PublishDiscovery(topic, "")
+	}
+}
+
+// publishDiscovery publishes the configuration of an entity of the device, identified by the node id. In device
+// mode the entity is added to the components of the device instead, which are published together shortly after.
+func (bridge *HomeAssistantBridge) publishDiscovery(nodeId string, component string, object string, config map[string]interface{}) {
+	if bridge.config.HomeAssistant.DiscoveryMode == HomeAssistantDiscoveryDevice {
+		bridge.addComponent(nodeId, component, object, config)
+		return
+	}
+
+	bridge.publishConfig(nodeId, fmt.Sprintf("%s/%s/%s/%s/config", bridge.discoveryPrefix, component, nodeId, object), config)
+}
+
+func (bridge *HomeAssistantBridge) addComponent(nodeId string, component string, object string, config map[string]interface{}) {
+	bridge.componentsMutex.Lock()
+	defer bridge.componentsMutex.Unlock()
+
+	// The device is shared by all components
+	bridge.componentDevices[nodeId] = config["device"]
+	delete(config, "device")
+	config["platform"] = component
+
+	if _, ok := bridge.components[nodeId]; !ok {
+		bridge.components[nodeId] = make(map[string]map[string]interface{})
+	}
+	bridge.components[nodeId][object] = config
+
+	if timer, ok := bridge.componentTimers[nodeId]; ok {
+		timer.Reset(homeAssistantDeviceDelay)
+		return
+	}
+
+	bridge.componentTimers[nodeId] = time.AfterFunc(homeAssistantDeviceDelay, func() {
+		bridge.publishDevice(nodeId)
+	})
+}
+
+// publishDevice publishes the configuration of the device containing all its components
+func (bridge *HomeAssistantBridge) publishDevice(nodeId string) {
+	bridge.componentsMutex.Lock()
+	delete(bridge.componentTimers, nodeId)
+
+	registered, ok := bridge.components[nodeId]
+	components := make(map[string]map[string]interface{}, len(registered))
+	for object, component := range registered {
+		components[object] = component
+	}
+	device := bridge.componentDevices[nodeId]
+	generation := bridge.generations[nodeId]
+	bridge.componentsMutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	config := map[string]interface{}{
+		"device": device,
+		"origin": map[string]interface{}{
+			"name":       "Cec2Mqtt",
+			"sw_version": BuildVersion,
+		},
+		"components": components,
+	}
+
+	log.WithFields(log.Fields{
+		"node_id":    nodeId,
+		"components": len(components),
+	}).Debug("Registering device in Home Assistant")
+
+	topic := fmt.Sprintf("%s/device/%s/config", bridge.discoveryPrefix, nodeId)
+	bridge.publishConfig(nodeId, topic, config)
+
+	// The device could have been unregistered while publishing, in which case its configuration is removed again.
+	// When it has been registered again since, the pending publish of its components replaces the configuration.
+	bridge.componentsMutex.Lock()
+	_, registeredAgain := bridge.components[nodeId]
+	unregistered := bridge.generations[nodeId] != generation && !registeredAgain
+	bridge.componentsMutex.Unlock()
+
+	if !unregistered {
+		return
+	}
+
+	bridge.topicsMutex.Lock()
+	delete(bridge.topics[nodeId], topic)
+	bridge.topicsMutex.Unlock()
 
-	bridge.mqtt.Publish(topic.String(), 0, true, encoded)
+	log.WithFields(log.Fields{
+		"node_id": nodeId,
+	}).Debug("Removing device which has been unregistered while publishing from Home Assistant")
+
+	bridge.mqtt.PublishDiscovery(topic, "")
 }
 
-func (bridge *HomeAssistantBridge) createConfig(device *Device, property string) map[string]interface{} {
+func (bridge *HomeAssistantBridge) publishConfig(nodeId string, topic string, config map[string]interface{}) {
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"topic":  topic,
+			"config": config,
+			"error":  err,
+		}).Error("Failed to convert discovery configuration to JSON")
+
+		return
+	}
+
+	bridge.topicsMutex.Lock()
+	if _, ok := bridge.topics[nodeId]; !ok {
+		bridge.topics[nodeId] = make(map[string]bool)
+	}
+	bridge.topics[nodeId][topic] = true
+	bridge.topicsMutex.Unlock()
+
+	bridge.mqtt.PublishDiscovery(topic, encoded)
+}
+
+func (bridge *HomeAssistantBridge) isDisabled(property string) bool {
+	for _, disabled := range bridge.config.HomeAssistant.DisabledFeatures {
+		if disabled == property {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sweepOrphans collects the retained discovery configurations published by cec2mqtt,
+// and removes those of devices which are ignored, and of disabled features.
+func (bridge *HomeAssistantBridge) sweepOrphans() {
+	// Only the node ids of cec2mqtt are used, which are those of the bridge and the known devices
+	nodeIds := []string{bridge.bridgeNodeId()}
+	for _, config := range bridge.devices.ListConfigs() {
+		nodeIds = append(nodeIds, config.Id)
+	}
+
+	// Both the configurations per entity and per device are collected, as the discovery mode may have changed
+	filters := make([]string, 0, 2*len(nodeIds))
+	for _, nodeId := range nodeIds {
+		filters = append(filters,
+			fmt.Sprintf("%s/+/%s/+/config", bridge.discoveryPrefix, nodeId),
+			fmt.Sprintf("%s/device/%s/config", bridge.discoveryPrefix, nodeId),
+		)
+	}
+
+	var mutex sync.Mutex
+	retained := make(map[string]bool)
+
+	for _, filter := range filters {
+		bridge.mqtt.SubscribeMessage(filter, 0, func(message *MqttMessage) {
+			if len(message.Payload) == 0 || !bridge.isOwnConfig(message.Payload) {
+				return
+			}
+
+			mutex.Lock()
+			retained[message.Topic] = true
+			mutex.Unlock()
+		})
+	}
+
+	time.AfterFunc(homeAssistantSweepDelay, func() {
+		for _, filter := range filters {
+			bridge.mqtt.Unsubscribe(filter)
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		for topic := range retained {
+			if bridge.isOrphan(topic) {
+				log.WithFields(log.Fields{
+					"topic": topic,
+				}).Info("Removing orphaned entity from Home Assistant")
+
+				bridge.mqtt.PublishDiscovery(topic, "")
+			}
+		}
+	})
+}
+
+// isOwnConfig checks whether the discovery configuration has been published by this instance of cec2mqtt
+func (bridge *HomeAssistantBridge) isOwnConfig(payload []byte) bool {
+	type entityConfig struct {
+		UniqueId string `json:"unique_id"`
+		Topic    string `json:"topic"`
+	}
+
+	var config struct {
+		entityConfig
+		Device struct {
+			Identifiers []string `json:"identifiers"`
+		} `json:"device"`
+		Components map[string]entityConfig `json:"components"`
+	}
+
+	if err := json.Unmarshal(payload, &config); err != nil {
+		return false
+	}
+
+	// Triggers don't have a unique id, but use a topic of cec2mqtt
+	isOwnEntity := func(entity entityConfig) bool {
+		return strings.HasSuffix(entity.UniqueId, "_"+bridge.config.Mqtt.BaseTopic) ||
+			strings.HasPrefix(entity.Topic, bridge.config.Mqtt.BaseTopic+"/")
+	}
+
+	own := isOwnEntity(config.entityConfig)
+	for _, component := range config.Components {
+		own = own || isOwnEntity(component)
+	}
+
+	if !own {
+		return false
+	}
+
+	for _, identifier := range config.Device.Identifiers {
+		if strings.HasPrefix(identifier, "cec2mqtt_") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (bridge *HomeAssistantBridge) isOrphan(topic string) bool {
+	// The topic is <prefix>/<component>/<device id>/<property>/config, or <prefix>/device/<device id>/config in device mode
+	levels := strings.Split(strings.TrimPrefix(topic, bridge.discoveryPrefix+"/"), "/")
+	deviceMode := bridge.config.HomeAssistant.DiscoveryMode == HomeAssistantDiscoveryDevice
+	if len(levels) == 3 && levels[0] == "device" {
+		return bridge.isOrphanDevice(topic, levels[1], deviceMode)
+	}
+	if len(levels) != 4 {
+		return false
+	}
+
+	// The entities are part of the configuration of the device in device mode
+	if deviceMode {
+		return true
+	}
+
+	deviceId, entity, feature := levels[1], levels[2], levels[2]
+	if deviceId == bridge.bridgeNodeId() {
+		return false
+	}
+
+	switch levels[0] {
+	case "device_automation":
+		feature = "keys"
+	case "button":
+		feature = "buttons"
+	case "sensor":
+		feature = "diagnostics"
+	}
+
+	bridge.topicsMutex.Lock()
+	published := bridge.topics[deviceId][topic]
+	bridge.topicsMutex.Unlock()
+
+	if published {
+		return false
+	}
+
+	// Devices which haven't been seen yet keep their entities
+	config, _ := bridge.devices.Find(deviceId)
+	if config == nil || config.Id != deviceId || config.Ignore || bridge.isDisabled(feature) {
+		return true
+	}
+
+	if levels[0] == "device_automation" {
+		entity = ""
+	}
+
+	return isHiddenEntity(config, entity)
+}
+
+func (bridge *HomeAssistantBridge) isOrphanDevice(topic string, deviceId string, deviceMode bool) bool {
+	if !deviceMode {
+		return true
+	}
+
+	bridge.topicsMutex.Lock()
+	published := bridge.topics[deviceId][topic]
+	bridge.topicsMutex.Unlock()
+
+	if published || deviceId == bridge.bridgeNodeId() {
+		return false
+	}
+
+	config, _ := bridge.devices.Find(deviceId)
+
+	return config == nil || config.Id != deviceId || config.Ignore || isHiddenEntity(config, "")
+}
+
+// createConfig creates the configuration of an entity for the state of the property, the
+// entity isn't created when it's hidden.
+func (bridge *HomeAssistantBridge) createConfig(device *Device, property string) (map[string]interface{}, bool) {
+	entity, ok := homeAssistantEntities[property]
+	if !ok {
+		entity = homeAssistantEntity{name: strings.Title(strings.ReplaceAll(property, "_", " "))}
+	}
+
+	if property == "power" {
+		if icon, ok := homeAssistantPowerIcons[DeviceType(device.LogicalAddress)]; ok {
+			entity.icon = icon
+		}
+	}
+
+	config, ok := bridge.createEntityConfig(device, property, entity)
+	if !ok {
+		return nil, false
+	}
+
+	config["state_topic"] = bridge.mqtt.BuildTopic(device, property)
+	if bridge.config.Mqtt.StateFormat == StateFormatJson {
+		config["state_topic"] = bridge.mqtt.BuildDeviceTopic(device)
+		// Booleans are converted to on and off, like these are published when using a topic per state
+		config["value_template"] = fmt.Sprintf(
+			"{%% if value_json.%[1]s is boolean %%}{{ 'on' if value_json.%[1]s else 'off' }}{%% else %%}{{ value_json.%[1]s }}{%% endif %%}",
+			property,
+		)
+	}
+
+	return config, true
+}
+
+// createEntityConfig creates the configuration shared by all entities, applying the overrides
+// of the device configuration to the defaults of the entity.
+func (bridge *HomeAssistantBridge) createEntityConfig(device *Device, object string, entity homeAssistantEntity) (map[string]interface{}, bool) {
+	if bridge.isHidden(device, object) {
+		log.WithFields(log.Fields{
+			"device.id": device.Id,
+			"entity":    object,
+		}).Debug("Not registering hidden entity in Home Assistant")
+		return nil, false
+	}
+
+	if deviceConfig := device.Config.HomeAssistant; deviceConfig != nil {
+		entity.disabled = entity.disabled || deviceConfig.Disabled
+
+		if override, ok := deviceConfig.Entities[object]; ok && override != nil {
+			if override.Name != "" {
+				entity.name = override.Name
+			}
+			if override.Icon != "" {
+				entity.icon = override.Icon
+			}
+			entity.disabled = entity.disabled || override.Disabled
+		}
+	}
+
 	config := map[string]interface{}{
-		"state_topic":           bridge.mqtt.BuildTopic(device, property),
-		"name":                  device.CecDevice.OSD + "_" + property,
-		"unique_id":             device.Id + "_" + property + "_" + bridge.config.Mqtt.BaseTopic,
+		"name":            entity.name,
+		"has_entity_name": true,
+		"unique_id":       device.Id + "_" + object + "_" + bridge.config.Mqtt.BaseTopic,
+		"device":          bridge.createDeviceConfig(device),
+	}
+
+	if entity.icon != "" {
+		config["icon"] = entity.icon
+	}
+	if entity.deviceClass != "" {
+		config["device_class"] = entity.deviceClass
+	}
+	if entity.entityCategory != "" {
+		config["entity_category"] = entity.entityCategory
+	}
+	if entity.disabled {
+		config["enabled_by_default"] = false
 	}
 
 	if bridge.config.Mqtt.StateTopic != "" {
@@ -127,14 +754,47 @@ func (bridge *HomeAssistantBridge) createConfig(device *Device, property string)
 		config["payload_not_available"] = bridge.config.Mqtt.WillMessage
 	}
 
-	deviceConfig := map[string]interface{}{
+	return config, true
+}
+
+func (bridge *HomeAssistantBridge) createDeviceConfig(device *Device) map[string]interface{} {
+	config := map[string]interface{}{
 		"identifiers":  []string{"cec2mqtt_" + device.Id},
 		"name":         device.CecDevice.OSD,
 		"sw_version":   "Cec2Mqtt " + BuildVersion,
 		"manufacturer": device.CecDevice.vendor.String(),
+		"model":        strings.Title(DeviceType(device.LogicalAddress)),
+	}
+
+	if deviceConfig := device.Config.HomeAssistant; deviceConfig != nil {
+		if deviceConfig.Name != "" {
+			config["name"] = deviceConfig.Name
+		}
+		if deviceConfig.Area != "" {
+			config["suggested_area"] = deviceConfig.Area
+		}
 	}
 
-	config["device"] = deviceConfig
+	config["via_device"] = "cec2mqtt_bridge_" + bridge.config.Mqtt.BaseTopic
 
 	return config
 }
+
+// isHidden checks whether the entity, or the whole device when the entity is empty, is hidden
+func (bridge *HomeAssistantBridge) isHidden(device *Device, entity string) bool {
+	return isHiddenEntity(device.Config, entity)
+}
+
+func isHiddenEntity(config *DeviceConfig, entity string) bool {
+	if config.HomeAssistant == nil {
+		return false
+	}
+
+	if config.HomeAssistant.Hide {
+		return true
+	}
+
+	override, ok := config.HomeAssistant.Entities[entity]
+
+	return ok && override != nil && override.Hide
+}
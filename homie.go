@@ -0,0 +1,414 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	// Runs after the features, so these are known when a device is added
+	RegisterInitializer(-100, InitHomiePublisher)
+}
+
+const homieVersion = "4.0.0"
+
+const (
+	HomieStateInit         = "init"
+	HomieStateReady        = "ready"
+	HomieStateDisconnected = "disconnected"
+	HomieStateLost         = "lost"
+)
+
+type homieNode struct {
+	id         string
+	name       string
+	nodeType   string
+	properties []homieProperty
+}
+
+type homieProperty struct {
+	// The property in the state store
+	property string
+	id       string
+	name     string
+	datatype string
+	format   string
+	settable bool
+	retained bool
+}
+
+// The nodes of a device, per feature
+var homieFeatures = map[string]homieNode{
+	"power": {id: "power", name: "Power", nodeType: "power", properties: []homieProperty{
+		{property: "power", id: "on", name: "On", datatype: "boolean", settable: true, retained: true},
+		{property: "power_status", id: "status", name: "Status", datatype: "enum", retained: true,
+			format: "on,standby,transition_to_on,transition_to_standby,unknown"},
+	}},
+	"is_active_source": {id: "source", name: "Source", nodeType: "source", properties: []homieProperty{
+		{property: "is_active_source", id: "active", name: "Active", datatype: "boolean", settable: true, retained: true},
+	}},
+	"keys": {id: "remote", name: "Remote", nodeType: "remote", properties: []homieProperty{
+		{property: "key", id: "key", name: "Key", datatype: "string", settable: true, retained: false},
+	}},
+	"diagnostics": {id: "info", name: "Information", nodeType: "diagnostics", properties: []homieProperty{
+		{property: "physical_address", id: "physical-address", name: "Physical address", datatype: "string", retained: true},
+		{property: "logical_address", id: "logical-address", name: "Logical address", datatype: "integer", retained: true},
+		{property: "vendor", id: "vendor", name: "Vendor", datatype: "string", retained: true},
+		{property: "cec_version", id: "cec-version", name: "CEC version", datatype: "string", retained: true},
+		{property: "device_type", id: "device-type", name: "Device type", datatype: "enum", retained: true,
+			format: "tv,recorder,tuner,playback,audio,other"},
+		{property: "last_seen", id: "last-seen", name: "Last seen", datatype: "datetime", retained: true},
+	}},
+}
+
+// HomiePublisher describes the devices following the Homie convention, so they
+// can be discovered by for example openHAB. Properties which can be set are
+// passed to the command handlers of the state store.
+type HomiePublisher struct {
+	mqtt      *Mqtt
+	devices   *DeviceRegistry
+	state     *DeviceStateStore
+	baseTopic string
+	bridgeId  string
+
+	mutex sync.Mutex
+	// The topics published per device, so these can be cleared
+	topics map[string]map[string]bool
+	states map[string]string
+	// The device using each Homie id
+	ids map[string]string
+}
+
+func InitHomiePublisher(container *Container) {
+	config := container.Get("config").(*Config)
+	if !config.Homie.Enable {
+		log.Info("Homie is not enabled, skipping")
+		return
+	}
+
+	mqtt := container.Get("mqtt").(*Mqtt)
+	devices := container.Get("devices").(*DeviceRegistry)
+	state := container.Get("state").(*DeviceStateStore)
+
+	publisher := &HomiePublisher{
+		mqtt:      mqtt,
+		devices:   devices,
+		state:     state,
+		baseTopic: config.Homie.BaseTopic,
+		bridgeId:  homieBridgeId(config),
+		topics:    make(map[string]map[string]bool),
+		states:    make(map[string]string),
+		ids:       make(map[string]string),
+	}
+
+	devices.RegisterDeviceAddedHandler(publisher.publishDevice)
+	devices.RegisterDeviceRemovedHandler(publisher.clearDevice)
+	state.RegisterStateHandler(publisher.publishValue)
+
+	mqtt.SubscribeMessage(publisher.baseTopic+"/+/+/+/set", 0, publisher.handleSet)
+
+	// The description is published again after a reconnect, as the state may have been changed by the will of another instance
+	mqtt.RegisterConnectedHandler(func() {
+		publisher.publishBridge(HomieStateInit)
+		for _, device := range devices.List() {
+			if !device.Config.Ignore {
+				publisher.publishDevice(device)
+			}
+		}
+		publisher.publishBridge(HomieStateReady)
+	})
+
+	// MQTT is connected before the initializers run, the devices are published once these are found
+	publisher.publishBridge(HomieStateReady)
+
+	container.Register("homie", publisher)
+}
+
+// Disconnect marks all devices, and cec2mqtt itself, as disconnected, which must be done before cec2mqtt exits
+func (publisher *HomiePublisher) Disconnect() {
+	for _, device := range publisher.devices.List() {
+		publisher.mutex.Lock()
+		_, published := publisher.states[device.Id]
+		publisher.mutex.Unlock()
+
+		if published {
+			publisher.setState(device, HomieStateDisconnected)
+		}
+	}
+
+	publisher.publishBridge(HomieStateDisconnected)
+}
+
+// HomieWill returns the will which marks cec2mqtt itself as lost when the connection is lost unexpectedly
+func HomieWill(config *Config) *MqttMessage {
+	return &MqttMessage{
+		Topic:    config.Homie.BaseTopic + "/" + homieBridgeId(config) + "/$state",
+		Payload:  []byte(HomieStateLost),
+		QoS:      1,
+		Retained: true,
+	}
+}
+
+// homieBridgeId returns the id of cec2mqtt itself, so multiple instances don't overwrite each other
+func homieBridgeId(config *Config) string {
+	return "bridge-" + strings.ReplaceAll(SlugifyTopic(config.Mqtt.BaseTopic), "_", "-")
+}
+
+// publishBridge describes cec2mqtt itself as a device without nodes. Its state shows
+// whether the states of the other devices are kept up to date.
+func (publisher *HomiePublisher) publishBridge(state string) {
+	prefix := publisher.baseTopic + "/" + publisher.bridgeId + "/"
+
+	publisher.mqtt.Publish(prefix+"$homie", 1, true, homieVersion)
+	publisher.mqtt.Publish(prefix+"$name", 1, true, "Cec2Mqtt")
+	publisher.mqtt.Publish(prefix+"$nodes", 1, true, "")
+	publisher.mqtt.Publish(prefix+"$extensions", 1, true, "")
+	publisher.mqtt.Publish(prefix+"$state", 1, true, state)
+}
+
+func (publisher *HomiePublisher) publishDevice(device *Device) {
+	if owner, ok := publisher.claimId(device); !ok {
+		log.WithFields(log.Fields{
+			"device.id": device.Id,
+			"homie.id":  homieId(device),
+			"owner.id":  owner,
+		}).Warn("Homie id is already used by another device, not publishing device. Rename one of the devices to publish it")
+		return
+	}
+
+	nodes := publisher.nodes(device)
+
+	log.WithFields(log.Fields{
+		"device.id": device.Id,
+		"homie.id":  homieId(device),
+	}).Debug("Publishing Homie device")
+
+	publisher.setState(device, HomieStateInit)
+
+	nodeIds := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		nodeIds = append(nodeIds, node.id)
+	}
+
+	publisher.publish(device, "$homie", homieVersion)
+	publisher.publish(device, "$name", device.CecDevice.OSD)
+	publisher.publish(device, "$nodes", strings.Join(nodeIds, ","))
+	publisher.publish(device, "$extensions", "")
+
+	for _, node := range nodes {
+		propertyIds := make([]string, 0, len(node.properties))
+		for _, property := range node.properties {
+			propertyIds = append(propertyIds, property.id)
+		}
+
+		publisher.publish(device, node.id+"/$name", node.name)
+		publisher.publish(device, node.id+"/$type", node.nodeType)
+		publisher.publish(device, node.id+"/$properties", strings.Join(propertyIds, ","))
+
+		for _, property := range node.properties {
+			prefix := node.id + "/" + property.id + "/"
+			publisher.publish(device, prefix+"$name", property.name)
+			publisher.publish(device, prefix+"$datatype", property.datatype)
+			publisher.publish(device, prefix+"$settable", fmt.Sprint(property.settable))
+			publisher.publish(device, prefix+"$retained", fmt.Sprint(property.retained))
+			if property.format != "" {
+				publisher.publish(device, prefix+"$format", property.format)
+			}
+
+			if value := publisher.state.Get(device, property.property); value != nil && property.retained {
+				if payload, ok := formatHomieValue(property, value); ok {
+					publisher.publish(device, node.id+"/"+property.id, payload)
+				}
+			}
+		}
+	}
+
+	publisher.setState(device, publisher.availability(device))
+}
+
+// clearDevice removes the retained topics of the device, which removes it from the controllers
+func (publisher *HomiePublisher) clearDevice(device *Device) {
+	publisher.mutex.Lock()
+	topics := publisher.topics[device.Id]
+	delete(publisher.topics, device.Id)
+	delete(publisher.states, device.Id)
+	for id, owner := range publisher.ids {
+		if owner == device.Id {
+			delete(publisher.ids, id)
+		}
+	}
+	publisher.mutex.Unlock()
+
+	log.WithFields(log.Fields{
+		"device.id": device.Id,
+	}).Debug("Removing Homie device")
+
+	for topic := range topics {
+		publisher.mqtt.Publish(topic, 1, true, "")
+	}
+}
+
+func (publisher *HomiePublisher) publishValue(device *Device, property string, value interface{}) {
+	publisher.mutex.Lock()
+	_, published := publisher.states[device.Id]
+	publisher.mutex.Unlock()
+
+	// The value is published together with the description
+	if !published {
+		return
+	}
+
+	for _, node := range publisher.nodes(device) {
+		for _, homieProperty := range node.properties {
+			if homieProperty.property != property || !homieProperty.retained {
+				continue
+			}
+
+			if payload, ok := formatHomieValue(homieProperty, value); ok {
+				publisher.publish(device, node.id+"/"+homieProperty.id, payload)
+			}
+		}
+	}
+
+	if property == "power" {
+		publisher.setState(device, publisher.availability(device))
+	}
+}
+
+func (publisher *HomiePublisher) handleSet(message *MqttMessage) {
+	// The topic is <base>/<device>/<node>/<property>/set
+	levels := strings.Split(strings.TrimPrefix(message.Topic, publisher.baseTopic+"/"), "/")
+	if len(levels) != 4 {
+		return
+	}
+
+	publisher.mutex.Lock()
+	deviceId, ok := publisher.ids[levels[0]]
+	publisher.mutex.Unlock()
+
+	var device *Device
+	if ok {
+		_, device = publisher.devices.Find(deviceId)
+	}
+
+	logContext := log.WithFields(log.Fields{
+		"topic": message.Topic,
+	})
+
+	if device == nil {
+		logContext.Debug("Received Homie command for unknown device")
+		return
+	}
+
+	for _, node := range publisher.nodes(device) {
+		if node.id != levels[1] {
+			continue
+		}
+
+		for _, property := range node.properties {
+			if property.id != levels[2] || !property.settable {
+				continue
+			}
+
+			publisher.state.HandleCommand(&DeviceCommand{
+				Device:   device,
+				Property: property.property,
+				Value:    string(message.Payload),
+				request:  message,
+				received: time.Now(),
+			})
+			return
+		}
+	}
+
+	logContext.Warn("Received Homie command for unknown property")
+}
+
+// availability returns the state of the device, which is lost when it doesn't respond anymore
+func (publisher *HomiePublisher) availability(device *Device) string {
+	if publisher.state.Get(device, "power") == "unknown" {
+		return HomieStateLost
+	}
+
+	return HomieStateReady
+}
+
+// claimId reserves the Homie id for the device, and returns the device already using it when it
+// can't be reserved. Different topics, like tv_1 and tv-1, result in the same id.
+func (publisher *HomiePublisher) claimId(device *Device) (string, bool) {
+	id := homieId(device)
+
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+
+	if owner, ok := publisher.ids[id]; ok && owner != device.Id {
+		return owner, false
+	}
+
+	publisher.ids[id] = device.Id
+
+	return device.Id, true
+}
+
+func (publisher *HomiePublisher) setState(device *Device, state string) {
+	publisher.mutex.Lock()
+	current, ok := publisher.states[device.Id]
+	publisher.states[device.Id] = state
+	publisher.mutex.Unlock()
+
+	if ok && current == state {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"device.id": device.Id,
+		"state":     state,
+	}).Debug("Updating Homie device state")
+
+	publisher.publish(device, "$state", state)
+}
+
+func (publisher *HomiePublisher) publish(device *Device, suffix string, payload string) {
+	topic := publisher.baseTopic + "/" + homieId(device) + "/" + suffix
+
+	publisher.mutex.Lock()
+	if _, ok := publisher.topics[device.Id]; !ok {
+		publisher.topics[device.Id] = make(map[string]bool)
+	}
+	publisher.topics[device.Id][topic] = true
+	publisher.mutex.Unlock()
+
+	// The convention requires all messages to be retained, using QoS 1
+	publisher.mqtt.Publish(topic, 1, true, payload)
+}
+
+// nodes returns the nodes of the features supported by the device
+func (publisher *HomiePublisher) nodes(device *Device) []homieNode {
+	nodes := make([]homieNode, 0)
+	for _, feature := range device.Features() {
+		if node, ok := homieFeatures[feature]; ok {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes
+}
+
+// homieId converts the topic of the device into an id, which may only contain lower case letters, digits and hyphens
+func homieId(device *Device) string {
+	return strings.ReplaceAll(SlugifyTopic(device.Config.MqttTopic), "_", "-")
+}
+
+// formatHomieValue converts the state into the payload of the property. Booleans
+// which aren't known, like the power of a device which doesn't respond, are skipped.
+func formatHomieValue(property homieProperty, value interface{}) (string, bool) {
+	if property.datatype == "boolean" {
+		on, ok := parseOnOff(value)
+		return fmt.Sprint(on), ok
+	}
+
+	return fmt.Sprint(value), true
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHomieAvailability(t *testing.T) {
+	tests := []struct {
+		name     string
+		states   map[string]interface{}
+		expected string
+	}{
+		{"on", map[string]interface{}{"power": "on"}, HomieStateReady},
+		{"off", map[string]interface{}{"power": "off"}, HomieStateReady},
+		{"unknown", map[string]interface{}{"power": "unknown"}, HomieStateLost},
+		{"without power", map[string]interface{}{}, HomieStateReady},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			device := &Device{Id: "tv", Config: &DeviceConfig{Id: "tv", MqttTopic: "tv"}}
+			publisher := &HomiePublisher{
+				state: &DeviceStateStore{states: map[string]map[string]interface{}{"tv": test.states}},
+			}
+
+			if state := publisher.availability(device); state != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, state)
+			}
+		})
+	}
+}
+
+func TestHomieClaimId(t *testing.T) {
+	publisher := &HomiePublisher{ids: make(map[string]string)}
+	first := &Device{Id: "a", Config: &DeviceConfig{Id: "a", MqttTopic: "tv_1"}}
+	second := &Device{Id: "b", Config: &DeviceConfig{Id: "b", MqttTopic: "tv-1"}}
+
+	if _, ok := publisher.claimId(first); !ok {
+		t.Fatal("Expected the id to be claimed by the first device")
+	}
+
+	if _, ok := publisher.claimId(first); !ok {
+		t.Error("Expected the id to be claimed again by the same device")
+	}
+
+	if owner, ok := publisher.claimId(second); ok || owner != "a" {
+		t.Errorf("Expected the id to be used by device a, got %s", owner)
+	}
+}
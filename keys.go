@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// cecKeys contains the names of the user control codes, the keys of a remote,
+// as defined by the CEC specification.
+var cecKeys = map[byte]string{
+	0x00: "select",
+	0x01: "up",
+	0x02: "down",
+	0x03: "left",
+	0x04: "right",
+	0x05: "right_up",
+	0x06: "right_down",
+	0x07: "left_up",
+	0x08: "left_down",
+	0x09: "root_menu",
+	0x0A: "setup_menu",
+	0x0B: "contents_menu",
+	0x0C: "favorite_menu",
+	0x0D: "exit",
+	0x10: "top_menu",
+	0x11: "context_menu",
+	0x1D: "number_entry_mode",
+	0x1E: "number_11",
+	0x1F: "number_12",
+	0x20: "number_0",
+	0x21: "number_1",
+	0x22: "number_2",
+	0x23: "number_3",
+	0x24: "number_4",
+	0x25: "number_5",
+	0x26: "number_6",
+	0x27: "number_7",
+	0x28: "number_8",
+	0x29: "number_9",
+	0x2A: "dot",
+	0x2B: "enter",
+	0x2C: "clear",
+	0x2F: "next_favorite",
+	0x30: "channel_up",
+	0x31: "channel_down",
+	0x32: "previous_channel",
+	0x33: "sound_select",
+	0x34: "input_select",
+	0x35: "display_information",
+	0x36: "help",
+	0x37: "page_up",
+	0x38: "page_down",
+	0x40: "power",
+	0x41: "volume_up",
+	0x42: "volume_down",
+	0x43: "mute",
+	0x44: "play",
+	0x45: "stop",
+	0x46: "pause",
+	0x47: "record",
+	0x48: "rewind",
+	0x49: "fast_forward",
+	0x4A: "eject",
+	0x4B: "forward",
+	0x4C: "backward",
+	0x4D: "stop_record",
+	0x4E: "pause_record",
+	0x50: "angle",
+	0x51: "sub_picture",
+	0x52: "video_on_demand",
+	0x53: "electronic_program_guide",
+	0x54: "timer_programming",
+	0x55: "initial_configuration",
+	0x56: "select_broadcast_type",
+	0x57: "select_sound_presentation",
+	0x60: "play_function",
+	0x61: "pause_play_function",
+	0x62: "record_function",
+	0x63: "pause_record_function",
+	0x64: "stop_function",
+	0x65: "mute_function",
+	0x66: "restore_volume_function",
+	0x67: "tune_function",
+	0x68: "select_media_function",
+	0x69: "select_av_input_function",
+	0x6A: "select_audio_input_function",
+	0x6B: "power_toggle_function",
+	0x6C: "power_off_function",
+	0x6D: "power_on_function",
+	0x71: "blue",
+	0x72: "red",
+	0x73: "green",
+	0x74: "yellow",
+	0x75: "f5",
+	0x76: "data",
+}
+
+// KeyName returns the name of the user control code
+func KeyName(code byte) string {
+	if name, ok := cecKeys[code]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("key_%02x", code)
+}
+
+// KeyCode returns the user control code of the key with the name
+func KeyCode(name string) (byte, bool) {
+	for code, keyName := range cecKeys {
+		if keyName == name {
+			return code, true
+		}
+	}
+
+	// Keys without a name are named by their code, like key_7f
+	hex := strings.TrimPrefix(name, "key_")
+	if hex == name || len(hex) != 2 {
+		return 0, false
+	}
+
+	code, err := strconv.ParseUint(hex, 16, 8)
+	if err != nil {
+		return 0, false
+	}
+
+	return byte(code), true
+}
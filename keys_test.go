@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestKeyCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     byte
+		expected bool
+	}{
+		{"select", 0x00, true},
+		{"up", 0x01, true},
+		{"power", 0x40, true},
+		{"power_on_function", 0x6D, true},
+		{"key_7f", 0x7F, true},
+		{"key_41garbage", 0, false},
+		{"key_7", 0, false},
+		{"key_-1", 0, false},
+		{"7f", 0, false},
+		{"unknown", 0, false},
+		{"", 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, ok := KeyCode(test.name)
+			if ok != test.expected {
+				t.Fatalf("Expected %v, got %v", test.expected, ok)
+			}
+
+			if ok && code != test.code {
+				t.Errorf("Expected code %02X, got %02X", test.code, code)
+			}
+		})
+	}
+}
+
+func TestKeyNameRoundTrip(t *testing.T) {
+	for code := 0; code <= 0xFF; code++ {
+		name := KeyName(byte(code))
+		if actual, ok := KeyCode(name); !ok || actual != byte(code) {
+			t.Errorf("Expected key %s to have code %02X, got %02X", name, code, actual)
+		}
+	}
+}
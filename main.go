@@ -53,6 +53,15 @@ func main() {
 	var logCecMessages bool
 	flag.BoolVar(&logCecMessages, "log-cec-messages", false, "Enables logging of the libcec log")
 
+	var captureFile string
+	flag.StringVar(&captureFile, "capture-file", "", "Writes all CEC traffic to this file as JSON lines")
+
+	var captureMaxSize int64
+	flag.Int64Var(&captureMaxSize, "capture-max-size", 10*1024*1024, "Sets the size in bytes at which the capture file is rotated")
+
+	var captureMaxFiles int
+	flag.IntVar(&captureMaxFiles, "capture-max-files", 5, "Sets the number of capture files to keep, including the current one")
+
 	flag.Parse()
 
 	switch logLevel {
@@ -93,7 +102,7 @@ func main() {
 	devices := NewDeviceRegistry(dataDir)
 	container.Register("devices", devices)
 
-	mqtt, err := ConnectMqtt(config)
+	mqtt, err := ConnectMqtt(config, dataDir)
 
 	if nil != err {
 		log.WithFields(log.Fields{
@@ -104,8 +113,7 @@ func main() {
 
 	container.Register("mqtt", mqtt)
 
-	cec, err := InitialiseCec(devices, "")
-	cec.LibCecLoggingEnabled = logCecMessages
+	cec, err := InitialiseCec(devices, config)
 
 	if nil != err {
 		log.WithFields(log.Fields{
@@ -113,11 +121,38 @@ func main() {
 		}).Fatal("Failed to setup CEC connection")
 	}
 
+	cec.LibCecLoggingEnabled = logCecMessages
+
+	if captureFile != "" {
+		capture, err := OpenTrafficCapture(captureFile, captureMaxSize, captureMaxFiles)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"capture_file": captureFile,
+				"error":        err,
+			}).Fatal("Failed to open capture file")
+		}
+
+		log.WithFields(log.Fields{
+			"capture_file": captureFile,
+		}).Info("Capturing CEC traffic")
+
+		cec.Capture = capture
+		defer capture.Close()
+	}
+
 	container.Register("cec", cec)
 
 	runInitializers(container)
 
-	cec.Start()
+	if err := cec.Start(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to open CEC connection")
+
+		if watchdog, ok := container.Get("watchdog").(*Watchdog); ok {
+			watchdog.Reconnect("failed to open connection")
+		}
+	}
 
 	signals := make(chan os.Signal, 1)
 	done := make(chan bool, 1)
@@ -132,6 +167,13 @@ func main() {
 	log.Info("Cec2Mqtt started")
 	<-done
 	log.Info("Exiting")
+
+	if homie, ok := container.Get("homie").(*HomiePublisher); ok {
+		homie.Disconnect()
+	}
+
+	mqtt.Disconnect()
+
 	config.Save(dataDir)
 	devices.Save(dataDir)
 }
@@ -7,6 +7,7 @@ type Runner func()
 
 type Monitor struct {
 	reset chan int
+	stop  chan int
 
 	longInterval  time.Duration
 	shortInterval time.Duration
@@ -20,6 +21,7 @@ type Monitor struct {
 func CreateMonitor(starter Starter, runner Runner, longInterval time.Duration, shortInterval time.Duration, shortDuration time.Duration) *Monitor {
 	monitor := &Monitor{
 		reset:         make(chan int),
+		stop:          make(chan int),
 		longInterval:  longInterval,
 		shortInterval: shortInterval,
 		shortDuration: shortDuration,
@@ -36,6 +38,11 @@ func (monitor *Monitor) Reset() {
 	monitor.reset <- 0
 }
 
+// Stop stops the monitor, after which it can't be reset anymore
+func (monitor *Monitor) Stop() {
+	monitor.stop <- 0
+}
+
 func (monitor *Monitor) run() {
 	monitor.starter()
 	monitor.runner()
@@ -45,6 +52,11 @@ func (monitor *Monitor) run() {
 
 	for {
 		select {
+		case <-monitor.stop:
+			ticker.Stop()
+			monitor.shortTimer.Stop()
+
+			return
 		case <-ticker.C:
 			monitor.runner()
 		case <-monitor.reset:
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const mqttPublishTimeout = 10 * time.Second
+
+type mqttV3Subscription struct {
+	qos     byte
+	handler mqtt.MessageHandler
+}
+
+// mqttV3Client connects using MQTT 3.1 or 3.1.1. As a clean session is used
+// the subscriptions are tracked, so these can be restored after a reconnect.
+type mqttV3Client struct {
+	client    mqtt.Client
+	onConnect func()
+
+	subscriptionsMutex sync.Mutex
+	subscriptions      map[string]*mqttV3Subscription
+	pending            mqttPendingMessages
+}
+
+func newMqttV3Client(config *MqttConfig, will *MqttMessage, tlsConfig *tls.Config, onConnect func()) *mqttV3Client {
+	client := &mqttV3Client{
+		onConnect:     onConnect,
+		subscriptions: make(map[string]*mqttV3Subscription),
+	}
+
+	options := mqtt.NewClientOptions()
+
+	options.AddBroker(config.Host)
+	options.SetProtocolVersion(uint(config.ProtocolVersion))
+	options.SetClientID(config.ClientId)
+	options.SetKeepAlive(config.KeepAlive)
+	options.SetConnectTimeout(config.ConnectTimeout)
+	options.SetCleanSession(*config.CleanSession)
+	options.SetOrderMatters(*config.OrderMatters)
+
+	if config.Username != "" {
+		options.SetUsername(config.Username)
+	}
+
+	if config.Password != "" {
+		options.SetPassword(config.Password)
+	}
+
+	if tlsConfig != nil {
+		options.SetTLSConfig(tlsConfig)
+	}
+
+	if will != nil {
+		options.SetWill(will.Topic, string(will.Payload), will.QoS, will.Retained)
+	}
+
+	// Retrying the initial connection is done by ConnectMqtt, after that paho reconnects by itself
+	options.SetConnectRetry(false)
+	options.SetAutoReconnect(true)
+	options.SetMaxReconnectInterval(config.MaxReconnectDelay)
+
+	options.SetDefaultPublishHandler(func(_ mqtt.Client, message mqtt.Message) {
+		client.pending.Add(newMqttV3Message(message))
+	})
+	options.SetOnConnectHandler(client.onConnected)
+	options.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Lost connection to MQTT, reconnecting")
+	})
+	options.SetReconnectingHandler(func(_ mqtt.Client, _ *mqtt.ClientOptions) {
+		log.Debug("Reconnecting to MQTT")
+	})
+
+	client.client = mqtt.NewClient(options)
+
+	return client
+}
+
+func (client *mqttV3Client) Connect() error {
+	connToken := client.client.Connect()
+
+	connToken.Wait()
+
+	return connToken.Error()
+}
+
+func (client *mqttV3Client) Disconnect() {
+	// Waits at most a second for the work in progress to be completed
+	client.client.Disconnect(1000)
+}
+
+func (client *mqttV3Client) onConnected(_ mqtt.Client) {
+	client.subscriptionsMutex.Lock()
+	for topic, subscription := range client.subscriptions {
+		client.subscribe(topic, subscription)
+	}
+	client.subscriptionsMutex.Unlock()
+
+	client.onConnect()
+}
+
+func (client *mqttV3Client) IsConnected() bool {
+	return client.client.IsConnectionOpen()
+}
+
+func (client *mqttV3Client) Publish(message *MqttMessage) error {
+	token := client.client.Publish(message.Topic, message.QoS, message.Retained, message.Payload)
+	if !token.WaitTimeout(mqttPublishTimeout) {
+		return errors.New("Timed out publishing MQTT message")
+	}
+
+	return token.Error()
+}
+
+func (client *mqttV3Client) Subscribe(topic string, qos byte, handler MqttMessageHandler) {
+	subscription := &mqttV3Subscription{
+		qos: qos,
+		handler: func(_ mqtt.Client, message mqtt.Message) {
+			handler(newMqttV3Message(message))
+		},
+	}
+
+	client.subscriptionsMutex.Lock()
+	client.subscriptions[topic] = subscription
+	client.subscriptionsMutex.Unlock()
+
+	// When the connection is down the subscription is made once it's restored
+	if client.client.IsConnectionOpen() {
+		client.subscribe(topic, subscription)
+	}
+
+	for _, message := range client.pending.Take(topic) {
+		handler(message)
+	}
+}
+
+func newMqttV3Message(message mqtt.Message) *MqttMessage {
+	return &MqttMessage{
+		Topic:    message.Topic(),
+		Payload:  message.Payload(),
+		QoS:      message.Qos(),
+		Retained: message.Retained(),
+	}
+}
+
+func (client *mqttV3Client) Unsubscribe(topic string) {
+	client.subscriptionsMutex.Lock()
+	delete(client.subscriptions, topic)
+	client.subscriptionsMutex.Unlock()
+
+	if !client.client.IsConnectionOpen() {
+		return
+	}
+
+	token := client.client.Unsubscribe(topic)
+	go logMqttV3Failure(token, topic, "Failed to unsubscribe from MQTT topic")
+}
+
+func (client *mqttV3Client) subscribe(topic string, subscription *mqttV3Subscription) {
+	token := client.client.Subscribe(topic, subscription.qos, subscription.handler)
+	go logMqttV3Failure(token, topic, "Failed to subscribe to MQTT topic")
+}
+
+// logMqttV3Failure waits for the token and logs when it failed. This is done in
+// its own goroutine, as waiting in a message handler deadlocks when the order matters.
+func logMqttV3Failure(token mqtt.Token, topic string, message string) {
+	token.Wait()
+
+	if err := token.Error(); err != nil {
+		log.WithFields(log.Fields{
+			"topic": topic,
+			"error": err,
+		}).Error(message)
+	}
+}
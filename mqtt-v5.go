@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const mqttV5Timeout = 10 * time.Second
+
+// How long the broker keeps the session when it isn't clean
+const mqttV5SessionExpiry = time.Hour
+
+type mqttV5Subscription struct {
+	qos     byte
+	handler MqttMessageHandler
+}
+
+// mqttV5Client connects using MQTT 5. Subscriptions are tracked and handled by
+// the client itself, so these can be restored when the connection is restored.
+type mqttV5Client struct {
+	host         string
+	clientConfig autopaho.ClientConfig
+	onConnect    func()
+	connected    int32
+
+	managerMutex sync.RWMutex
+	manager      *autopaho.ConnectionManager
+
+	subscriptionsMutex sync.RWMutex
+	subscriptions      map[string]*mqttV5Subscription
+	pending            mqttPendingMessages
+}
+
+func newMqttV5Client(config *MqttConfig, will *MqttMessage, tlsConfig *tls.Config, onConnect func()) *mqttV5Client {
+	client := &mqttV5Client{
+		host:          config.Host,
+		onConnect:     onConnect,
+		subscriptions: make(map[string]*mqttV5Subscription),
+	}
+
+	client.clientConfig = autopaho.ClientConfig{
+		TlsCfg:         tlsConfig,
+		KeepAlive:      uint16(config.KeepAlive.Seconds()),
+		ConnectTimeout: config.ConnectTimeout,
+		OnConnectionUp: client.onConnectionUp,
+		OnConnectError: func(err error) {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to connect to MQTT")
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: config.ClientId,
+			Router:   paho.NewSingleHandlerRouter(client.route),
+			OnClientError: func(err error) {
+				atomic.StoreInt32(&client.connected, 0)
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Warn("Lost connection to MQTT, reconnecting")
+			},
+			OnServerDisconnect: func(disconnect *paho.Disconnect) {
+				atomic.StoreInt32(&client.connected, 0)
+				log.WithFields(log.Fields{
+					"reason_code": disconnect.ReasonCode,
+				}).Warn("Disconnected by MQTT broker, reconnecting")
+			},
+		},
+	}
+
+	client.clientConfig.SetUsernamePassword(config.Username, []byte(config.Password))
+
+	cleanSession := *config.CleanSession
+	client.clientConfig.SetConnectPacketConfigurator(func(connect *paho.Connect) *paho.Connect {
+		connect.CleanStart = cleanSession
+		if !cleanSession {
+			expiry := uint32(mqttV5SessionExpiry.Seconds())
+			if connect.Properties == nil {
+				connect.Properties = &paho.ConnectProperties{}
+			}
+			connect.Properties.SessionExpiryInterval = &expiry
+		}
+
+		return connect
+	})
+
+	if will != nil {
+		client.clientConfig.SetWillMessage(will.Topic, will.Payload, will.QoS, will.Retained)
+	}
+
+	return client
+}
+
+// Connect starts the connection manager, which keeps (re)connecting in the
+// background. Calling it again only waits for the connection to come up.
+func (client *mqttV5Client) Connect() error {
+	manager := client.getManager()
+	if manager == nil {
+		broker, err := url.Parse(client.brokerUrl())
+		if err != nil {
+			return err
+		}
+		client.clientConfig.BrokerUrls = []*url.URL{broker}
+
+		manager, err = autopaho.NewConnection(context.Background(), client.clientConfig)
+		if err != nil {
+			return err
+		}
+		client.setManager(manager)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqttV5Timeout)
+	defer cancel()
+
+	return manager.AwaitConnection(ctx)
+}
+
+// The connection manager starts connecting before NewConnection returns, so
+// it's also set from the connected callback before any handler runs.
+func (client *mqttV5Client) Disconnect() {
+	manager := client.getManager()
+	if manager == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqttV5Timeout)
+	defer cancel()
+
+	if err := manager.Disconnect(ctx); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Failed to disconnect from MQTT")
+	}
+}
+
+func (client *mqttV5Client) setManager(manager *autopaho.ConnectionManager) {
+	client.managerMutex.Lock()
+	defer client.managerMutex.Unlock()
+
+	client.manager = manager
+}
+
+func (client *mqttV5Client) getManager() *autopaho.ConnectionManager {
+	client.managerMutex.RLock()
+	defer client.managerMutex.RUnlock()
+
+	return client.manager
+}
+
+func (client *mqttV5Client) brokerUrl() string {
+	host := client.host
+	// Like the MQTT 3 client, default to TCP when the host doesn't contain a scheme
+	if !strings.Contains(host, "://") {
+		host = "tcp://" + host
+	}
+
+	return host
+}
+
+func (client *mqttV5Client) onConnectionUp(manager *autopaho.ConnectionManager, _ *paho.Connack) {
+	client.setManager(manager)
+
+	client.subscriptionsMutex.RLock()
+	subscribe := &paho.Subscribe{
+		Subscriptions: make(map[string]paho.SubscribeOptions),
+	}
+	for topic, subscription := range client.subscriptions {
+		subscribe.Subscriptions[topic] = paho.SubscribeOptions{QoS: subscription.qos}
+	}
+	client.subscriptionsMutex.RUnlock()
+
+	if len(subscribe.Subscriptions) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), mqttV5Timeout)
+		defer cancel()
+
+		if _, err := manager.Subscribe(ctx, subscribe); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to restore MQTT subscriptions")
+		}
+	}
+
+	atomic.StoreInt32(&client.connected, 1)
+
+	client.onConnect()
+}
+
+func (client *mqttV5Client) IsConnected() bool {
+	return atomic.LoadInt32(&client.connected) == 1
+}
+
+func (client *mqttV5Client) Publish(message *MqttMessage) error {
+	publish := &paho.Publish{
+		Topic:   message.Topic,
+		QoS:     message.QoS,
+		Retain:  message.Retained,
+		Payload: message.Payload,
+		Properties: &paho.PublishProperties{
+			ResponseTopic:   message.ResponseTopic,
+			CorrelationData: message.CorrelationData,
+		},
+	}
+
+	if message.MessageExpiry > 0 {
+		expiry := message.MessageExpiry
+		publish.Properties.MessageExpiry = &expiry
+	}
+
+	for key, value := range message.UserProperties {
+		publish.Properties.User.Add(key, value)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqttV5Timeout)
+	defer cancel()
+
+	manager := client.getManager()
+	if manager == nil {
+		return autopaho.ConnectionDownError
+	}
+
+	_, err := manager.Publish(ctx, publish)
+
+	return err
+}
+
+func (client *mqttV5Client) Subscribe(topic string, qos byte, handler MqttMessageHandler) {
+	client.subscriptionsMutex.Lock()
+	client.subscriptions[topic] = &mqttV5Subscription{qos: qos, handler: handler}
+	client.subscriptionsMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqttV5Timeout)
+	defer cancel()
+
+	// When the connection is down the subscription is made once it's restored
+	if manager := client.getManager(); manager != nil {
+		_, err := manager.Subscribe(ctx, &paho.Subscribe{
+			Subscriptions: map[string]paho.SubscribeOptions{
+				topic: {QoS: qos},
+			},
+		})
+
+		if err != nil && err != autopaho.ConnectionDownError {
+			log.WithFields(log.Fields{
+				"topic": topic,
+				"error": err,
+			}).Error("Failed to subscribe to MQTT topic")
+		}
+	}
+
+	for _, message := range client.pending.Take(topic) {
+		handler(message)
+	}
+}
+
+func (client *mqttV5Client) Unsubscribe(topic string) {
+	client.subscriptionsMutex.Lock()
+	delete(client.subscriptions, topic)
+	client.subscriptionsMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqttV5Timeout)
+	defer cancel()
+
+	manager := client.getManager()
+	if manager == nil {
+		return
+	}
+
+	_, err := manager.Unsubscribe(ctx, &paho.Unsubscribe{
+		Topics: []string{topic},
+	})
+
+	if err != nil && err != autopaho.ConnectionDownError {
+		log.WithFields(log.Fields{
+			"topic": topic,
+			"error": err,
+		}).Error("Failed to unsubscribe from MQTT topic")
+	}
+}
+
+func (client *mqttV5Client) route(publish *paho.Publish) {
+	message := &MqttMessage{
+		Topic:    publish.Topic,
+		Payload:  publish.Payload,
+		QoS:      publish.QoS,
+		Retained: publish.Retain,
+	}
+
+	if properties := publish.Properties; properties != nil {
+		message.ResponseTopic = properties.ResponseTopic
+		message.CorrelationData = properties.CorrelationData
+		if properties.MessageExpiry != nil {
+			message.MessageExpiry = *properties.MessageExpiry
+		}
+
+		if len(properties.User) > 0 {
+			message.UserProperties = make(map[string]string)
+			for _, property := range properties.User {
+				message.UserProperties[property.Key] = property.Value
+			}
+		}
+	}
+
+	client.subscriptionsMutex.RLock()
+	handlers := make([]MqttMessageHandler, 0, 1)
+	for topic, subscription := range client.subscriptions {
+		if topicMatches(topic, message.Topic) {
+			handlers = append(handlers, subscription.handler)
+		}
+	}
+	if len(handlers) == 0 {
+		// Added while holding the lock, so it can't be missed by a subscription made in the meantime
+		client.pending.Add(message)
+	}
+	client.subscriptionsMutex.RUnlock()
+
+	for _, handler := range handlers {
+		handler(message)
+	}
+}
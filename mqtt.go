@@ -1,93 +1,521 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/eclipse/paho.mqtt.golang"
 	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 type MqttConnectedHandler func()
 
+// drainRetryDelay is how long to wait before publishing the outbox again after a failure
+const drainRetryDelay = 5 * time.Second
+
+// mqttClient is the part of the MQTT connection which depends on the protocol version
+type mqttClient interface {
+	Connect() error
+	Disconnect()
+	IsConnected() bool
+	Publish(message *MqttMessage) error
+	Subscribe(topic string, qos byte, handler MqttMessageHandler)
+	Unsubscribe(topic string)
+}
+
 type Mqtt struct {
-	client mqtt.Client
-	config *MqttConfig
+	client            mqttClient
+	config            *MqttConfig
 	connectedHandlers []MqttConnectedHandler
+
+	outbox         *Outbox
+	drainMutex     sync.Mutex
+	drainScheduled bool
+	metricsLock    sync.Mutex
+	metrics        MqttMetrics
+}
+
+// MqttMetrics counts the results of publishing messages
+type MqttMetrics struct {
+	Published uint64 `json:"published"`
+	Failed    uint64 `json:"failed"`
+	Queued    uint64 `json:"queued"`
+	Expired   uint64 `json:"expired"`
+	Pending   int    `json:"pending"`
+}
+
+// MqttMessage is a message to publish or which has been received. The
+// properties are only supported when using MQTT 5.
+type MqttMessage struct {
+	Topic           string            `json:"topic"`
+	Payload         []byte            `json:"payload"`
+	QoS             byte              `json:"qos"`
+	Retained        bool              `json:"retained"`
+	ResponseTopic   string            `json:"response_topic,omitempty"`
+	CorrelationData []byte            `json:"correlation_data,omitempty"`
+	UserProperties  map[string]string `json:"user_properties,omitempty"`
+	MessageExpiry   uint32            `json:"message_expiry,omitempty"`
 }
 
 type MessageHandler func(payload []byte)
+type MqttMessageHandler func(message *MqttMessage)
+
+const mqttMetricsInterval = time.Minute
 
-func ConnectMqtt(config *Config) (*Mqtt, error) {
+func ConnectMqtt(config *Config, dataDir string) (*Mqtt, error) {
 	mqttConfig := config.Mqtt
-	options := mqtt.NewClientOptions()
 
-	options.AddBroker(mqttConfig.Host)
+	if mqttConfig.ClientId == "" {
+		// Not stored in the configuration, so it follows the data directory when it's moved
+		mqttConfig.ClientId = defaultClientId(dataDir)
+	}
+
+	log.WithFields(log.Fields{
+		"client_id": mqttConfig.ClientId,
+	}).Debug("Using MQTT client id")
+
+	tlsConfig, err := createTlsConfig(&mqttConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	outboxPath := ""
+	if mqttConfig.PersistOutbox {
+		outboxPath = dataDir + "outbox.json"
+	}
+
+	// MQTT supports a single will. With Homie it marks cec2mqtt as lost, the state topic is
+	// then only updated when cec2mqtt exits normally
+	var will *MqttMessage
+	if config.Homie.Enable {
+		will = HomieWill(config)
+	} else if mqttConfig.StateTopic != "" && mqttConfig.WillMessage != "" {
+		will = &MqttMessage{Topic: mqttConfig.StateTopic, Payload: []byte(mqttConfig.WillMessage), Retained: true}
+	}
+
+	inst := &Mqtt{
+		config: &mqttConfig,
+		outbox: NewOutbox(outboxPath),
+	}
 
-	if mqttConfig.Username != "" {
-		options.SetUsername(mqttConfig.Username)
+	switch mqttConfig.ProtocolVersion {
+	case 3, 4:
+		inst.client = newMqttV3Client(&mqttConfig, will, tlsConfig, inst.onConnected)
+	case 5:
+		inst.client = newMqttV5Client(&mqttConfig, will, tlsConfig, inst.onConnected)
+	default:
+		return nil, fmt.Errorf("MQTT protocol version %d is not supported", mqttConfig.ProtocolVersion)
 	}
 
-	if mqttConfig.Password != "" {
-		options.SetPassword(mqttConfig.Password)
+	if err := inst.connect(); err != nil {
+		return nil, err
 	}
 
-	if mqttConfig.StateTopic != "" {
-		if mqttConfig.WillMessage != "" {
-			options.SetWill(mqttConfig.StateTopic, mqttConfig.WillMessage, 0, true)
+	go inst.publishMetricsPeriodically()
+
+	return inst, nil
+}
+
+// defaultClientId generates a client id which is unique to the data directory, so
+// multiple instances of cec2mqtt can connect to the same broker.
+func defaultClientId(dataDir string) string {
+	if absolute, err := filepath.Abs(dataDir); err == nil {
+		dataDir = absolute
+	}
+
+	hash := sha256.Sum256([]byte(dataDir))
+
+	return "cec2mqtt-" + hex.EncodeToString(hash[:4])
+}
+
+// connect makes the initial connection, retrying with an increasing delay
+// until connect_retries is reached. When it is 0 it keeps retrying.
+func (mqtt *Mqtt) connect() error {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := mqtt.client.Connect()
+		if err == nil {
+			return nil
 		}
+
+		if mqtt.config.ConnectRetries > 0 && attempt > mqtt.config.ConnectRetries {
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"host":    mqtt.config.Host,
+			"attempt": attempt,
+			"error":   err,
+			"backoff": backoff,
+		}).Error("Failed to connect to MQTT, retrying")
+
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > mqtt.config.MaxReconnectDelay {
+			backoff = mqtt.config.MaxReconnectDelay
+		}
+	}
+}
+
+// Disconnect publishes the will message to the state topic and disconnects, which
+// must be done before cec2mqtt exits. The broker doesn't publish the will itself then.
+func (mqtt *Mqtt) Disconnect() {
+	if mqtt.config.StateTopic != "" && mqtt.config.WillMessage != "" {
+		// Not queued in the outbox, as it would be published after the birth message once connected again
+		message := &MqttMessage{Topic: mqtt.config.StateTopic, Payload: []byte(mqtt.config.WillMessage), Retained: true}
+		if err := mqtt.client.Publish(message); err != nil {
+			mqtt.publishFailed(message, err)
+		}
+	}
+
+	mqtt.client.Disconnect()
+}
+
+func (mqtt *Mqtt) onConnected() {
+	log.WithFields(log.Fields{
+		"protocol_version": mqtt.config.ProtocolVersion,
+	}).Info("Connected to MQTT")
+
+	if mqtt.config.StateTopic != "" && mqtt.config.BirthMessage != "" {
+		mqtt.Publish(mqtt.config.StateTopic, 0, true, mqtt.config.BirthMessage)
 	}
 
-	var client mqtt.Client
-	var inst *Mqtt
+	mqtt.drain()
+	mqtt.publishMetrics()
 
-	options.SetOnConnectHandler(func(client mqtt.Client) {
-		log.Info("Connected to MQTT")
-		if mqttConfig.StateTopic != "" && mqttConfig.BirthMessage != "" {
-			client.Publish(mqttConfig.StateTopic, 0, true, mqttConfig.BirthMessage)
+	for _, handler := range mqtt.connectedHandlers {
+		handler()
+	}
+}
+
+func createTlsConfig(mqttConfig *MqttConfig) (*tls.Config, error) {
+	if mqttConfig.CaFile == "" && mqttConfig.CertFile == "" && mqttConfig.KeyFile == "" &&
+		!mqttConfig.InsecureSkipVerify && mqttConfig.ServerName == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: mqttConfig.InsecureSkipVerify,
+		ServerName:         mqttConfig.ServerName,
+	}
+
+	if mqttConfig.CaFile != "" {
+		data, err := ioutil.ReadFile(mqttConfig.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA file %s: %w", mqttConfig.CaFile, err)
 		}
 
-		for _, handler := range inst.connectedHandlers {
-			handler()
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("CA file " + mqttConfig.CaFile + " does not contain any PEM encoded certificates")
 		}
-	})
 
-	client = mqtt.NewClient(options)
+		tlsConfig.RootCAs = pool
+	}
 
-	connToken := client.Connect()
+	if mqttConfig.CertFile != "" || mqttConfig.KeyFile != "" {
+		if mqttConfig.CertFile == "" || mqttConfig.KeyFile == "" {
+			return nil, errors.New("Both cert_file and key_file must be configured to use a client certificate")
+		}
 
-	connToken.Wait()
+		certificate, err := tls.LoadX509KeyPair(mqttConfig.CertFile, mqttConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate %s with key %s: %w", mqttConfig.CertFile, mqttConfig.KeyFile, err)
+		}
 
-	inst = &Mqtt{
-		client: client,
-		config: &mqttConfig,
+		tlsConfig.Certificates = []tls.Certificate{certificate}
 	}
 
-	return inst, nil
+	if mqttConfig.InsecureSkipVerify {
+		log.Warn("Verification of the MQTT broker certificate is disabled")
+	}
+
+	return tlsConfig, nil
 }
 
 func (mqtt *Mqtt) BuildTopic(device *Device, suffix string) string {
 	topic := strings.Builder{}
-	fmt.Fprintf(&topic, "%s/%s/%s", mqtt.config.BaseTopic, device.Config.MqttTopic, suffix)
+	fmt.Fprintf(&topic, "%s/%s", mqtt.BuildDeviceTopic(device), suffix)
+	return topic.String()
+}
+
+// BuildDeviceTopic builds the topic of the device from the topic template, which
+// is the template without the property.
+func (mqtt *Mqtt) BuildDeviceTopic(device *Device) string {
+	template := strings.TrimSuffix(mqtt.config.TopicTemplate, "/{property}")
+
+	return strings.NewReplacer(
+		"{base}", mqtt.config.BaseTopic,
+		"{name}", device.Config.MqttTopic,
+		"{id}", device.Id,
+		"{type}", DeviceType(device.LogicalAddress),
+	).Replace(template)
+}
+
+func (mqtt *Mqtt) BuildBridgeTopic(suffix string) string {
+	topic := strings.Builder{}
+	fmt.Fprintf(&topic, "%s/bridge/%s", mqtt.config.BaseTopic, suffix)
 	return topic.String()
 }
 
 func (mqtt *Mqtt) Publish(topic string, qos byte, retained bool, payload interface{}) {
-	mqtt.client.Publish(topic, qos, retained, payload)
+	mqtt.PublishMessage(&MqttMessage{
+		Topic:    topic,
+		Payload:  payloadToBytes(payload),
+		QoS:      qos,
+		Retained: retained,
+	})
+}
+
+// PublishDeviceState publishes a state of the device, including the device as user properties.
+func (mqtt *Mqtt) PublishDeviceState(device *Device, property string, payload interface{}) {
+	mqtt.publishDeviceMessage(device, mqtt.BuildTopic(device, property), false, payload)
+}
+
+// PublishDeviceDocument publishes all states of the device as a single (retained) JSON document.
+func (mqtt *Mqtt) PublishDeviceDocument(device *Device, payload interface{}) {
+	mqtt.publishDeviceMessage(device, mqtt.BuildDeviceTopic(device), true, payload)
+}
+
+func (mqtt *Mqtt) publishDeviceMessage(device *Device, topic string, retain bool, payload interface{}) {
+	qos, retained := mqtt.config.PublishOptions(&mqtt.config.State, retain)
+
+	mqtt.PublishMessage(&MqttMessage{
+		Topic:    topic,
+		Payload:  payloadToBytes(payload),
+		QoS:      qos,
+		Retained: retained,
+		UserProperties: map[string]string{
+			"device_id":       device.Id,
+			"logical_address": fmt.Sprintf("%d", device.LogicalAddress),
+		},
+	})
+}
+
+// ClearDeviceState removes the retained state of the device from the broker.
+func (mqtt *Mqtt) ClearDeviceState(device *Device, property string) {
+	qos, _ := mqtt.config.PublishOptions(&mqtt.config.State, false)
+
+	mqtt.Publish(mqtt.BuildTopic(device, property), qos, true, "")
+}
+
+// ClearDeviceDocument removes the retained JSON document of the device from the broker.
+func (mqtt *Mqtt) ClearDeviceDocument(device *Device) {
+	qos, _ := mqtt.config.PublishOptions(&mqtt.config.State, true)
+
+	mqtt.Publish(mqtt.BuildDeviceTopic(device), qos, true, "")
+}
+
+// Respond publishes the response to a request. When the request has been made
+// using MQTT 5 its response topic and correlation data are used.
+func (mqtt *Mqtt) Respond(request *MqttMessage, topic string, payload interface{}) {
+	qos, _ := mqtt.config.PublishOptions(&mqtt.config.Events, false)
+
+	response := &MqttMessage{
+		Topic:   topic,
+		Payload: payloadToBytes(payload),
+		QoS:     qos,
+	}
+
+	if request != nil {
+		if request.ResponseTopic != "" {
+			response.Topic = request.ResponseTopic
+		}
+		response.CorrelationData = request.CorrelationData
+	}
+
+	mqtt.PublishMessage(response)
+}
+
+func (mqtt *Mqtt) PublishDiscovery(topic string, payload interface{}) {
+	qos, retained := mqtt.config.PublishOptions(&mqtt.config.Discovery, true)
+
+	mqtt.Publish(topic, qos, retained, payload)
+}
+
+func (mqtt *Mqtt) PublishEvent(topic string, payload interface{}) {
+	qos, retained := mqtt.config.PublishOptions(&mqtt.config.Events, false)
+
+	mqtt.Publish(topic, qos, retained, payload)
+}
+
+// PublishMessage publishes the message. When the broker can't be reached the
+// message is queued in the outbox, and published once the connection is restored.
+func (mqtt *Mqtt) PublishMessage(message *MqttMessage) {
+	if message.MessageExpiry == 0 && !message.Retained && mqtt.config.MessageExpiry > 0 {
+		message.MessageExpiry = uint32(mqtt.config.MessageExpiry.Seconds())
+	}
+
+	// The drain mutex is held while publishing, so a message can't overtake one being drained
+	mqtt.drainMutex.Lock()
+	defer mqtt.drainMutex.Unlock()
+
+	// Messages are queued as long as older messages are waiting, to keep them in order
+	if !mqtt.client.IsConnected() || mqtt.outbox.Len() > 0 {
+		mqtt.queue(message)
+		mqtt.drainQueued()
+		return
+	}
+
+	if err := mqtt.client.Publish(message); err != nil {
+		mqtt.publishFailed(message, err)
+		mqtt.queue(message)
+		mqtt.scheduleDrain()
+		return
+	}
+
+	mqtt.published(message)
+}
+
+func (mqtt *Mqtt) queue(message *MqttMessage) {
+	mqtt.outbox.Add(message)
+
+	mqtt.metricsLock.Lock()
+	mqtt.metrics.Queued++
+	mqtt.metricsLock.Unlock()
+
 	log.WithFields(log.Fields{
-		"topic":    topic,
-		"qos":      qos,
-		"retained": retained,
-		"payload":  payload,
+		"topic": message.Topic,
+	}).Debug("Queued MQTT message until the broker can be reached")
+}
+
+// drain publishes the queued messages, as long as the broker can be reached.
+func (mqtt *Mqtt) drain() {
+	mqtt.drainMutex.Lock()
+	defer mqtt.drainMutex.Unlock()
+
+	mqtt.drainScheduled = false
+	mqtt.drainQueued()
+}
+
+// drainQueued does the actual draining, the drain mutex must be held
+func (mqtt *Mqtt) drainQueued() {
+	for mqtt.client.IsConnected() {
+		entry := mqtt.outbox.Peek()
+		if entry == nil {
+			return
+		}
+
+		if entry.Expired() {
+			mqtt.outbox.Remove(entry)
+
+			mqtt.metricsLock.Lock()
+			mqtt.metrics.Expired++
+			mqtt.metricsLock.Unlock()
+
+			log.WithFields(log.Fields{
+				"topic": entry.Message.Topic,
+			}).Debug("Dropping queued MQTT message as it has expired")
+			continue
+		}
+
+		if err := mqtt.client.Publish(entry.Message); err != nil {
+			mqtt.publishFailed(entry.Message, err)
+			mqtt.scheduleDrain()
+			return
+		}
+
+		mqtt.outbox.Remove(entry)
+		mqtt.published(entry.Message)
+	}
+}
+
+// scheduleDrain retries draining later when publishing failed while still
+// connected, as the connected handler won't drain the outbox in that case.
+// The drain mutex must be held.
+func (mqtt *Mqtt) scheduleDrain() {
+	if mqtt.drainScheduled || !mqtt.client.IsConnected() {
+		return
+	}
+
+	mqtt.drainScheduled = true
+	time.AfterFunc(drainRetryDelay, mqtt.drain)
+}
+
+func (mqtt *Mqtt) published(message *MqttMessage) {
+	mqtt.metricsLock.Lock()
+	mqtt.metrics.Published++
+	mqtt.metricsLock.Unlock()
+
+	log.WithFields(log.Fields{
+		"topic":    message.Topic,
+		"qos":      message.QoS,
+		"retained": message.Retained,
+		"payload":  string(message.Payload),
 	}).Trace("Published MQTT message")
 }
 
+func (mqtt *Mqtt) publishFailed(message *MqttMessage, err error) {
+	mqtt.metricsLock.Lock()
+	mqtt.metrics.Failed++
+	mqtt.metricsLock.Unlock()
+
+	log.WithFields(log.Fields{
+		"topic": message.Topic,
+		"error": err,
+	}).Warn("Failed to publish MQTT message")
+}
+
+// Metrics returns a snapshot of the publish metrics
+func (mqtt *Mqtt) Metrics() MqttMetrics {
+	mqtt.metricsLock.Lock()
+	metrics := mqtt.metrics
+	mqtt.metricsLock.Unlock()
+
+	metrics.Pending = mqtt.outbox.Len()
+
+	return metrics
+}
+
+func (mqtt *Mqtt) publishMetrics() {
+	encoded, err := json.Marshal(mqtt.Metrics())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to convert MQTT metrics into JSON")
+		return
+	}
+
+	mqtt.Publish(mqtt.BuildBridgeTopic("metrics"), 0, true, encoded)
+}
+
+func (mqtt *Mqtt) publishMetricsPeriodically() {
+	ticker := time.NewTicker(mqttMetricsInterval)
+
+	for range ticker.C {
+		if mqtt.client.IsConnected() {
+			mqtt.publishMetrics()
+		}
+	}
+}
+
 func (m *Mqtt) Subscribe(topic string, qos byte, callback MessageHandler) {
-	m.client.Subscribe(topic, qos, func(_ mqtt.Client, message mqtt.Message) {
+	m.SubscribeMessage(topic, qos, func(message *MqttMessage) {
+		callback(message.Payload)
+	})
+}
+
+func (m *Mqtt) SubscribeMessage(topic string, qos byte, callback MqttMessageHandler) {
+	// The broker only keeps messages for a persistent session when these have been subscribed to with at least QoS 1
+	if !*m.config.CleanSession && qos == 0 {
+		qos = 1
+	}
+
+	m.client.Subscribe(topic, qos, func(message *MqttMessage) {
 		log.WithFields(log.Fields{
-			"topic":   message.Topic(),
-			"payload": message.Payload(),
+			"topic":   message.Topic,
+			"payload": message.Payload,
 		}).Trace("Handling incoming MQTT message")
-		callback(message.Payload())
+		callback(message)
 	})
 	log.WithFields(log.Fields{
 		"topic": topic,
@@ -95,6 +523,88 @@ func (m *Mqtt) Subscribe(topic string, qos byte, callback MessageHandler) {
 	}).Trace("Subscribed to MQTT topic")
 }
 
+func (m *Mqtt) Unsubscribe(topic string) {
+	m.client.Unsubscribe(topic)
+	log.WithFields(log.Fields{
+		"topic": topic,
+	}).Trace("Unsubscribed from MQTT topic")
+}
+
 func (m *Mqtt) RegisterConnectedHandler(handler MqttConnectedHandler) {
 	m.connectedHandlers = append(m.connectedHandlers, handler)
 }
+
+// Messages for a persistent session can arrive before the topic has been subscribed
+// to again, these are kept until the subscription is made.
+const mqttMaxPendingMessages = 100
+
+type mqttPendingMessages struct {
+	mutex    sync.Mutex
+	messages []*MqttMessage
+}
+
+func (pending *mqttPendingMessages) Add(message *MqttMessage) {
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+
+	if len(pending.messages) >= mqttMaxPendingMessages {
+		log.WithFields(log.Fields{
+			"topic": pending.messages[0].Topic,
+		}).Warn("Dropping MQTT message which hasn't been subscribed to")
+		pending.messages = pending.messages[1:]
+	}
+
+	pending.messages = append(pending.messages, message)
+}
+
+// Take removes and returns the messages matching the filter
+func (pending *mqttPendingMessages) Take(filter string) []*MqttMessage {
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+
+	taken := make([]*MqttMessage, 0)
+	remaining := pending.messages[:0]
+	for _, message := range pending.messages {
+		if topicMatches(filter, message.Topic) {
+			taken = append(taken, message)
+		} else {
+			remaining = append(remaining, message)
+		}
+	}
+	pending.messages = remaining
+
+	return taken
+}
+
+// topicMatches checks whether the topic matches the filter, which may contain wildcards.
+func topicMatches(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+func payloadToBytes(payload interface{}) []byte {
+	switch value := payload.(type) {
+	case []byte:
+		return value
+	case string:
+		return []byte(value)
+	default:
+		return []byte(fmt.Sprint(value))
+	}
+}
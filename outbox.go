@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+type outboxEntry struct {
+	Message *MqttMessage `json:"message"`
+	Queued  time.Time    `json:"queued"`
+}
+
+// Outbox holds the messages which couldn't be published yet. Only the latest
+// message of each topic is kept, in the order in which these were queued.
+// When a path is given the outbox is persisted to that file.
+type Outbox struct {
+	path string
+
+	mutex   sync.Mutex
+	entries []*outboxEntry
+}
+
+func NewOutbox(path string) *Outbox {
+	outbox := &Outbox{
+		path:    path,
+		entries: make([]*outboxEntry, 0),
+	}
+
+	if path != "" {
+		outbox.load()
+	}
+
+	return outbox
+}
+
+func (outbox *Outbox) load() {
+	logContext := log.WithFields(log.Fields{
+		"outbox_file": outbox.path,
+	})
+
+	data, err := ioutil.ReadFile(outbox.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logContext.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to read outbox file")
+		}
+		return
+	}
+
+	if err := json.Unmarshal(data, &outbox.entries); err != nil {
+		logContext.WithFields(log.Fields{
+			"error": err,
+		}).Error("Outbox file could not be parsed as valid JSON")
+		outbox.entries = make([]*outboxEntry, 0)
+		return
+	}
+
+	if len(outbox.entries) > 0 {
+		logContext.WithFields(log.Fields{
+			"messages": len(outbox.entries),
+		}).Info("Loaded unpublished MQTT messages")
+	}
+}
+
+// save writes the outbox to its file, the mutex must be held by the caller
+func (outbox *Outbox) save() {
+	if outbox.path == "" {
+		return
+	}
+
+	data, err := json.Marshal(outbox.entries)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to convert outbox into JSON")
+		return
+	}
+
+	if err := ioutil.WriteFile(outbox.path, data, 0644); err != nil {
+		log.WithFields(log.Fields{
+			"error":       err,
+			"outbox_file": outbox.path,
+		}).Error("Failed to save outbox to file")
+	}
+}
+
+// Add queues the message, replacing any queued message for the same topic.
+func (outbox *Outbox) Add(message *MqttMessage) {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+
+	for i, entry := range outbox.entries {
+		if entry.Message.Topic == message.Topic {
+			outbox.entries = append(outbox.entries[:i], outbox.entries[i+1:]...)
+			break
+		}
+	}
+
+	outbox.entries = append(outbox.entries, &outboxEntry{
+		Message: message,
+		Queued:  time.Now(),
+	})
+
+	outbox.save()
+}
+
+// Peek returns the oldest queued entry, or nil when the outbox is empty.
+func (outbox *Outbox) Peek() *outboxEntry {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+
+	if len(outbox.entries) == 0 {
+		return nil
+	}
+
+	return outbox.entries[0]
+}
+
+// Remove removes the entry, unless it has been replaced by a newer message in the meantime.
+func (outbox *Outbox) Remove(removed *outboxEntry) {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+
+	for i, entry := range outbox.entries {
+		if entry == removed {
+			outbox.entries = append(outbox.entries[:i], outbox.entries[i+1:]...)
+			outbox.save()
+			return
+		}
+	}
+}
+
+func (outbox *Outbox) Len() int {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+
+	return len(outbox.entries)
+}
+
+// Expired checks whether the message expired while it was queued
+func (entry *outboxEntry) Expired() bool {
+	expiry := time.Duration(entry.Message.MessageExpiry) * time.Second
+
+	return expiry > 0 && time.Since(entry.Queued) > expiry
+}
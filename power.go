@@ -1,7 +1,7 @@
 package main
 
 import (
-	"github.com/RobertMe/gocec"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"sync"
 	"time"
@@ -14,12 +14,17 @@ func init() {
 type PowerState struct {
 	state string
 	published bool
+	// The power status as reported by the device, including the transitions
+	status PowerStatus
+	// The mutex is held while publishing, so the updates of a device are published in order
+	mutex sync.Mutex
 }
 
 type PowerBridge struct {
 	cec      *Cec
 	mqtt     *Mqtt
 	devices  *DeviceRegistry
+	state    *DeviceStateStore
 	haBridge *HomeAssistantBridge
 
 	monitors      map[string]*Monitor
@@ -34,10 +39,12 @@ func InitPowerBridge(container *Container) {
 	cec := container.Get("cec").(*Cec)
 	mqtt := container.Get("mqtt").(*Mqtt)
 	devices := container.Get("devices").(*DeviceRegistry)
-	bridge := PowerBridge{
-		cec:  cec,
-		mqtt: mqtt,
+	state := container.Get("state").(*DeviceStateStore)
+	bridge := &PowerBridge{
+		cec:     cec,
+		mqtt:    mqtt,
 		devices: devices,
+		state:   state,
 
 		monitors: make(map[string]*Monitor),
 		states:   make(map[string]*PowerState),
@@ -46,11 +53,13 @@ func InitPowerBridge(container *Container) {
 	container.Register("bridge.power", bridge)
 
 	devices.RegisterDeviceAddedHandler(func(device *Device) {
+		device.AddFeature("power")
+
 		bridge.statesMutex.Lock()
 		bridge.monitorsMutex.Lock()
 		defer bridge.statesMutex.Unlock()
 		defer bridge.monitorsMutex.Unlock()
-		bridge.states[device.Id] = &PowerState{state: "unknown", published: false}
+		bridge.states[device.Id] = &PowerState{state: "unknown", published: false, status: PowerStatusUnknown}
 		bridge.monitors[device.Id] = CreateMonitor(
 			bridge.createStarter(device),
 			bridge.createRunner(device),
@@ -58,30 +67,49 @@ func InitPowerBridge(container *Container) {
 			5*time.Second,
 			time.Minute,
 		)
+	})
 
-		log.WithFields(log.Fields{
-			"device.id": device.Id,
-		}).Debug("Subscribing to power change requests")
+	devices.RegisterDeviceRemovedHandler(func(device *Device) {
+		bridge.monitorsMutex.Lock()
+		monitor, ok := bridge.monitors[device.Id]
+		delete(bridge.monitors, device.Id)
+		bridge.monitorsMutex.Unlock()
+
+		// The monitor updates the state, so it must be stopped without holding the lock
+		if ok {
+			monitor.Stop()
+		}
+
+		bridge.statesMutex.Lock()
+		delete(bridge.states, device.Id)
+		bridge.statesMutex.Unlock()
+	})
 
-		mqtt.Subscribe(mqtt.BuildTopic(device, "power/set"), 0, func(payload []byte) {
+	state.RegisterCommandHandler("power", func(command *DeviceCommand) (interface{}, error) {
+		device := command.Device
+		on, ok := parseOnOff(command.Value)
+		if !ok {
 			log.WithFields(log.Fields{
 				"device.id": device.Id,
-				"payload":   payload,
-			})
-			switch string(payload) {
-			case "on":
-				log.WithFields(log.Fields{
-					"device.id": device.Id,
-				}).Info("Powering device on as requested on MQTT")
-				cec.connection.PowerOnDevice(device.LogicalAddress)
-			case "off":
-				log.WithFields(log.Fields{
-					"device.id": device.Id,
-				}).Info("Turning device into standby as requested on MQTT")
-				cec.connection.StandByDevice(device.LogicalAddress)
-			}
-		})
-	})
+				"value":     command.Value,
+			}).Warn("Received invalid power command on MQTT")
+			return nil, fmt.Errorf("Invalid power state %v, must be on or off", command.Value)
+		}
+
+		if on {
+			log.WithFields(log.Fields{
+				"device.id": device.Id,
+			}).Info("Powering device on as requested on MQTT")
+			cec.PowerOnDevice(device.LogicalAddress)
+			return "on", nil
+		}
+
+		log.WithFields(log.Fields{
+			"device.id": device.Id,
+		}).Info("Turning device into standby as requested on MQTT")
+		cec.StandByDevice(device.LogicalAddress)
+		return "off", nil
+	}, OpcodeImageViewOn, OpcodeUserControlPressed, OpcodeStandby)
 
 	if haBridge, ok := container.Get("home-assistant").(*HomeAssistantBridge); ok {
 		log.Info("Enabling Home Assistant configuration for power")
@@ -92,13 +120,13 @@ func InitPowerBridge(container *Container) {
 		haBridge.RegisterBirthHandler(bridge.resendAll)
 	}
 
-	getDevice := func(address gocec.LogicalAddress) *Device {
+	getDevice := func(address LogicalAddress) *Device {
 		return devices.FindByLogicalAddress(address)
 	}
 
-	cec.RegisterMessageHandler(func(message gocec.Message) {
+	cec.RegisterMessageHandler(func(message Message) {
 		device := getDevice(message.Source())
-		status := gocec.PowerStatus(message[2])
+		status := PowerStatus(message[2])
 
 		log.WithFields(log.Fields{
 			"device.id": device.Id,
@@ -106,9 +134,9 @@ func InitPowerBridge(container *Container) {
 		}).Debug("New power status received")
 
 		bridge.setPowerStatus(device, status)
-	}, gocec.OpcodeReportPowerStatus)
+	}, OpcodeReportPowerStatus)
 
-	cec.RegisterMessageHandler(func(message gocec.Message) {
+	cec.RegisterMessageHandler(func(message Message) {
 		device := getDevice(message.Source())
 
 		log.WithFields(log.Fields{
@@ -116,9 +144,9 @@ func InitPowerBridge(container *Container) {
 		}).Debug("Restarting power monitor because of system audio mode change")
 
 		bridge.MonitorPower(device.Id)
-	}, gocec.OpcodeSetSystemAudioMode)
+	}, OpcodeSetSystemAudioMode)
 
-	cec.RegisterMessageHandler(func(message gocec.Message) {
+	cec.RegisterMessageHandler(func(message Message) {
 		log.WithFields(log.Fields{
 			"message.source":      message.Source(),
 			"message.destination": message.Destination(),
@@ -129,7 +157,15 @@ func InitPowerBridge(container *Container) {
 		for deviceId, _ := range bridge.states {
 			bridge.MonitorPower(deviceId)
 		}
-	}, gocec.OpcodeStandby, gocec.OpcodeActiveSource)
+	}, OpcodeStandby, OpcodeActiveSource)
+
+	cec.RegisterReconnectedHandler(func() {
+		log.Debug("Restarting power monitor on all devices because CEC connection has been restored")
+
+		for _, device := range devices.List() {
+			bridge.MonitorPower(device.Id)
+		}
+	})
 
 	mqtt.RegisterConnectedHandler(bridge.resendAll)
 }
@@ -143,20 +179,35 @@ func (bridge *PowerBridge) MonitorPower(deviceId string) {
 	}
 }
 
-func (bridge *PowerBridge) setPowerStatus(device *Device, status gocec.PowerStatus) {
+func (bridge *PowerBridge) setPowerStatus(device *Device, status PowerStatus) {
 	var value string
 	switch status {
-	case gocec.PowerStatusOn, gocec.PowerStatusTransitionToStandby:
+	case PowerStatusOn, PowerStatusTransitionToStandby:
 		value = "on"
-	case gocec.PowerStatusStandBy, gocec.PowerStatusTransitionToOn:
+	case PowerStatusStandBy, PowerStatusTransitionToOn:
 		value = "off"
 	default:
 		value = "unknown"
 	}
 
 	bridge.statesMutex.Lock()
-	state := bridge.states[device.Id]
-	defer bridge.statesMutex.Unlock()
+	state, ok := bridge.states[device.Id]
+	if !ok {
+		bridge.statesMutex.Unlock()
+		// The device has been removed in the meantime
+		return
+	}
+
+	// The device's lock is taken before releasing the bridge's, so a newer update can't overtake this one
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	bridge.statesMutex.Unlock()
+
+	if state.status != status {
+		state.status = status
+		bridge.state.Set(device, "power_status", PowerStatusName(status))
+	}
+
 	if state.state == value && state.published {
 		return
 	}
@@ -171,7 +222,7 @@ func (bridge *PowerBridge) setPowerStatus(device *Device, status gocec.PowerStat
 	state.state = value
 
 	if value != "unknown" || !state.published {
-		go bridge.mqtt.Publish(bridge.mqtt.BuildTopic(device, "power"), 0, false, value)
+		bridge.state.Set(device, "power", value)
 		state.published = true
 	} else {
 		state.published = false
@@ -179,13 +230,13 @@ func (bridge *PowerBridge) setPowerStatus(device *Device, status gocec.PowerStat
 }
 
 func (bridge *PowerBridge) createStarter(device *Device) Starter {
-	source := gocec.DeviceTV
+	source := DeviceTV
 
-	if device.LogicalAddress == gocec.DeviceTV {
-		source = gocec.DeviceBroadcast
+	if device.LogicalAddress == DeviceTV {
+		source = DeviceBroadcast
 	}
 
-	message := gocec.NewMessage(source, device.LogicalAddress, gocec.OpcodeGiveDevicePowerStatus, []byte{})
+	message := NewMessage(source, device.LogicalAddress, OpcodeGiveDevicePowerStatus, []byte{})
 
 	context := log.WithFields(log.Fields{
 		"device.logical_address": device.LogicalAddress,
@@ -208,7 +259,7 @@ func (bridge *PowerBridge) createStarter(device *Device) Starter {
 
 func (bridge *PowerBridge) createRunner(device *Device) Runner {
 	return func() {
-		status := bridge.cec.connection.GetPowerStatus(device.LogicalAddress)
+		status := bridge.cec.GetPowerStatus(device.LogicalAddress)
 
 		log.WithFields(log.Fields{
 			"device.logical_address": device.LogicalAddress,
@@ -222,12 +273,18 @@ func (bridge *PowerBridge) createRunner(device *Device) Runner {
 
 func (bridge *PowerBridge) resendAll() {
 	log.Debug("Resending all power states")
+
+	// The states are copied, so they're published without holding the lock
 	bridge.statesMutex.Lock()
-	defer bridge.statesMutex.Unlock()
+	states := make(map[string]*PowerState, len(bridge.states))
+	for id, state := range bridge.states {
+		states[id] = state
+	}
+	bridge.statesMutex.Unlock()
+
 	for _, device := range bridge.devices.List() {
-		var state *PowerState
-		var ok bool
-		if state, ok = bridge.states[device.Id]; !ok {
+		state, ok := states[device.Id]
+		if !ok {
 			continue
 		}
 
@@ -235,6 +292,25 @@ func (bridge *PowerBridge) resendAll() {
 			bridge.haBridge.RegisterSwitch(device, "power")
 		}
 
-		bridge.mqtt.Publish(bridge.mqtt.BuildTopic(device, "power"), 0, false, state.state)
+		state.mutex.Lock()
+		bridge.state.Set(device, "power", state.state)
+		bridge.state.Set(device, "power_status", PowerStatusName(state.status))
+		state.mutex.Unlock()
+	}
+}
+
+// PowerStatusName returns the name of the power status as reported by the device
+func PowerStatusName(status PowerStatus) string {
+	switch status {
+	case PowerStatusOn:
+		return "on"
+	case PowerStatusStandBy:
+		return "standby"
+	case PowerStatusTransitionToOn:
+		return "transition_to_on"
+	case PowerStatusTransitionToStandby:
+		return "transition_to_standby"
+	default:
+		return "unknown"
 	}
 }
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterInitializer(0, InitRemoteKeysBridge)
+}
+
+const (
+	KeyShortPress = "button_short_press"
+	KeyLongPress  = "button_long_press"
+)
+
+// A key which is held for this long is a long press
+const keyLongPressDuration = 500 * time.Millisecond
+
+// Not all devices send a release, so a key is considered released when it hasn't been repeated for this long
+const keyReleaseTimeout = time.Second
+
+type keyPress struct {
+	code    byte
+	pressed time.Time
+	timer   *time.Timer
+}
+
+type keyEventPayload struct {
+	Key  string `json:"key"`
+	Code byte   `json:"code"`
+	Type string `json:"type"`
+}
+
+// RemoteKeysBridge publishes the keys of a remote, sent by a device, as events, and
+// sends keys requested on MQTT to a device. With the Home Assistant integration a
+// trigger is registered for every key which has been sent, or for the configured
+// keys, and buttons are registered for the keys configured for the type of device.
+type RemoteKeysBridge struct {
+	mqtt     *Mqtt
+	devices  *DeviceRegistry
+	config   *Config
+	haBridge *HomeAssistantBridge
+
+	mutex   sync.Mutex
+	presses map[string]*keyPress
+	// The keys for which triggers have been registered, per device
+	triggers map[string]map[string]bool
+}
+
+func InitRemoteKeysBridge(container *Container) {
+	cec := container.Get("cec").(*Cec)
+	mqtt := container.Get("mqtt").(*Mqtt)
+	devices := container.Get("devices").(*DeviceRegistry)
+	state := container.Get("state").(*DeviceStateStore)
+	config := container.Get("config").(*Config)
+
+	bridge := &RemoteKeysBridge{
+		mqtt:     mqtt,
+		devices:  devices,
+		config:   config,
+		presses:  make(map[string]*keyPress),
+		triggers: make(map[string]map[string]bool),
+	}
+
+	devices.RegisterDeviceAddedHandler(func(device *Device) {
+		device.AddFeature("keys")
+	})
+
+	state.RegisterCommandHandler("key", func(command *DeviceCommand) (interface{}, error) {
+		device := command.Device
+		code, ok := KeyCode(fmt.Sprint(command.Value))
+		if !ok {
+			log.WithFields(log.Fields{
+				"device.id": device.Id,
+				"value":     command.Value,
+			}).Warn("Received unknown key on MQTT")
+			return nil, fmt.Errorf("Unknown key %v", command.Value)
+		}
+
+		log.WithFields(log.Fields{
+			"device.id": device.Id,
+			"key":       KeyName(code),
+		}).Info("Sending key to device as requested on MQTT")
+		cec.SendKey(device.LogicalAddress, code)
+
+		// Sending a key doesn't result in a state which can be confirmed
+		return nil, nil
+	}, OpcodeUserControlPressed)
+
+	if haBridge, ok := container.Get("home-assistant").(*HomeAssistantBridge); ok {
+		log.Info("Enabling Home Assistant triggers for remote keys")
+		bridge.haBridge = haBridge
+
+		devices.RegisterDeviceAddedHandler(func(device *Device) {
+			for _, key := range config.HomeAssistant.TriggerKeys {
+				if _, ok := KeyCode(key); !ok {
+					log.WithFields(log.Fields{
+						"key": key,
+					}).Warn("Unknown key configured for Home Assistant triggers")
+					continue
+				}
+
+				bridge.registerTriggers(device, key)
+			}
+
+			bridge.registerButtons(device)
+		})
+		devices.RegisterDeviceRemovedHandler(func(device *Device) {
+			bridge.mutex.Lock()
+			delete(bridge.triggers, device.Id)
+			bridge.mutex.Unlock()
+		})
+		haBridge.RegisterBirthHandler(bridge.resendAll)
+	}
+
+	cec.RegisterMessageHandler(func(message Message) {
+		device := devices.FindByLogicalAddress(message.Source())
+		if device == nil || len(message.Parameters()) < 1 {
+			return
+		}
+
+		bridge.pressed(device, message.Parameters()[0])
+	}, OpcodeUserControlPressed)
+
+	cec.RegisterMessageHandler(func(message Message) {
+		device := devices.FindByLogicalAddress(message.Source())
+		if device == nil {
+			return
+		}
+
+		bridge.released(device)
+	}, OpcodeUserControlRelease)
+
+	container.Register("remote-keys", bridge)
+}
+
+func (bridge *RemoteKeysBridge) pressed(device *Device, code byte) {
+	bridge.mutex.Lock()
+	defer bridge.mutex.Unlock()
+
+	press, ok := bridge.presses[device.Id]
+	if ok && press.code == code {
+		// The key is repeated while it's being held
+		press.timer.Reset(keyReleaseTimeout)
+		return
+	}
+
+	if ok {
+		// Another key has been pressed without releasing the previous one
+		bridge.finish(device, press, time.Now())
+	}
+
+	log.WithFields(log.Fields{
+		"device.id": device.Id,
+		"key":       KeyName(code),
+	}).Debug("Key pressed")
+
+	press = &keyPress{
+		code:    code,
+		pressed: time.Now(),
+	}
+	press.timer = time.AfterFunc(keyReleaseTimeout, func() {
+		bridge.mutex.Lock()
+		defer bridge.mutex.Unlock()
+
+		if bridge.presses[device.Id] == press {
+			bridge.finish(device, press, time.Now().Add(-keyReleaseTimeout))
+		}
+	})
+	bridge.presses[device.Id] = press
+}
+
+func (bridge *RemoteKeysBridge) released(device *Device) {
+	bridge.mutex.Lock()
+	defer bridge.mutex.Unlock()
+
+	if press, ok := bridge.presses[device.Id]; ok {
+		bridge.finish(device, press, time.Now())
+	}
+}
+
+// finish publishes the event of the key press, the mutex must be held by the caller
+func (bridge *RemoteKeysBridge) finish(device *Device, press *keyPress, released time.Time) {
+	press.timer.Stop()
+	delete(bridge.presses, device.Id)
+
+	payload := &keyEventPayload{
+		Key:  KeyName(press.code),
+		Code: press.code,
+		Type: KeyShortPress,
+	}
+	if released.Sub(press.pressed) >= keyLongPressDuration {
+		payload.Type = KeyLongPress
+	}
+
+	log.WithFields(log.Fields{
+		"device.id": device.Id,
+		"key":       payload.Key,
+		"type":      payload.Type,
+	}).Info("Publishing remote key")
+
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to convert remote key to JSON")
+		return
+	}
+
+	go func() {
+		bridge.mqtt.PublishEvent(bridge.mqtt.BuildTopic(device, "key"), encoded)
+
+		if bridge.haBridge != nil {
+			bridge.registerTriggers(device, payload.Key)
+		}
+	}()
+}
+
+func (bridge *RemoteKeysBridge) registerTriggers(device *Device, key string) {
+	bridge.mutex.Lock()
+	if _, ok := bridge.triggers[device.Id]; !ok {
+		bridge.triggers[device.Id] = make(map[string]bool)
+	}
+	registered := bridge.triggers[device.Id][key]
+	bridge.triggers[device.Id][key] = true
+	bridge.mutex.Unlock()
+
+	if registered {
+		return
+	}
+
+	bridge.haBridge.RegisterTrigger(device, KeyShortPress, key)
+	bridge.haBridge.RegisterTrigger(device, KeyLongPress, key)
+}
+
+func (bridge *RemoteKeysBridge) registerButtons(device *Device) {
+	for _, key := range bridge.config.HomeAssistant.Buttons[DeviceType(device.LogicalAddress)] {
+		bridge.haBridge.RegisterButton(device, key)
+	}
+}
+
+func (bridge *RemoteKeysBridge) resendAll() {
+	log.Debug("Resending all remote key triggers and buttons")
+
+	bridge.mutex.Lock()
+	triggers := make(map[string][]string)
+	for deviceId, keys := range bridge.triggers {
+		for key := range keys {
+			triggers[deviceId] = append(triggers[deviceId], key)
+		}
+	}
+	bridge.mutex.Unlock()
+
+	for _, device := range bridge.devices.List() {
+		if device.Config.Ignore {
+			continue
+		}
+
+		bridge.registerButtons(device)
+
+		for _, key := range triggers[device.Id] {
+			bridge.haBridge.RegisterTrigger(device, KeyShortPress, key)
+			bridge.haBridge.RegisterTrigger(device, KeyLongPress, key)
+		}
+	}
+}
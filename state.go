@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterInitializer(200, InitDeviceStateStore)
+}
+
+// DeviceStateHandler is called after the state of a device has changed
+type DeviceStateHandler func(device *Device, property string, value interface{})
+
+const (
+	// StateFormatTopics publishes every state of a device to its own topic
+	StateFormatTopics = "topics"
+	// StateFormatJson publishes all states of a device as a single JSON document
+	StateFormatJson = "json"
+)
+
+// DeviceStateStore holds the states of all devices, and publishes these in the
+// configured format. Commands for a property, routed from either the set topic
+// of the property or the set topic of the device, are passed to its command handler.
+type DeviceStateStore struct {
+	mqtt    *Mqtt
+	router  *CommandRouter
+	format  string
+	tracker *CommandTracker
+
+	properties      []string
+	commandHandlers map[string]DeviceCommandHandler
+	commandOpcodes  map[string][]Opcode
+	stateHandlers   []DeviceStateHandler
+
+	statesMutex sync.Mutex
+	states      map[string]map[string]interface{}
+	// Held while setting and publishing a state, so the states of a device are published in order
+	publishMutexes map[string]*sync.Mutex
+}
+
+func InitDeviceStateStore(container *Container) {
+	mqtt := container.Get("mqtt").(*Mqtt)
+	config := container.Get("config").(*Config)
+	devices := container.Get("devices").(*DeviceRegistry)
+	cec := container.Get("cec").(*Cec)
+
+	store := &DeviceStateStore{
+		mqtt:            mqtt,
+		router:          container.Get("command-router").(*CommandRouter),
+		tracker:         NewCommandTracker(cec, mqtt, &config.Commands),
+		format:          config.Mqtt.StateFormat,
+		properties:      make([]string, 0),
+		commandHandlers: make(map[string]DeviceCommandHandler),
+		commandOpcodes:  make(map[string][]Opcode),
+		states:          make(map[string]map[string]interface{}),
+		publishMutexes:  make(map[string]*sync.Mutex),
+	}
+
+	devices.RegisterDeviceRemovedHandler(store.Clear)
+
+	if store.format == StateFormatJson {
+		store.router.RegisterDocumentHandler(store.handleDocument)
+	}
+
+	container.Register("state", store)
+}
+
+// RegisterProperty registers a property which is stored for the devices.
+func (store *DeviceStateStore) RegisterProperty(property string) {
+	for _, existing := range store.properties {
+		if existing == property {
+			return
+		}
+	}
+
+	store.properties = append(store.properties, property)
+}
+
+// RegisterCommandHandler registers the handler for commands which change the property.
+// The opcodes are those the handler sends, used to track whether the command is acknowledged.
+func (store *DeviceStateStore) RegisterCommandHandler(property string, handler DeviceCommandHandler, opcodes ...Opcode) {
+	store.RegisterProperty(property)
+	store.commandHandlers[property] = handler
+	store.commandOpcodes[property] = opcodes
+
+	if store.format == StateFormatTopics {
+		store.router.RegisterHandler(property, func(device *Device, message *MqttMessage) {
+			store.handleValue(device, property, message)
+		})
+	}
+}
+
+// RegisterStateHandler registers a handler which is called whenever a state is set.
+func (store *DeviceStateStore) RegisterStateHandler(handler DeviceStateHandler) {
+	store.stateHandlers = append(store.stateHandlers, handler)
+}
+
+func (store *DeviceStateStore) Format() string {
+	return store.format
+}
+
+// Set updates the state of the device and publishes it.
+func (store *DeviceStateStore) Set(device *Device, property string, value interface{}) {
+	publishMutex := store.publishMutex(device)
+	publishMutex.Lock()
+	defer publishMutex.Unlock()
+
+	store.statesMutex.Lock()
+	state, ok := store.states[device.Id]
+	if !ok {
+		state = make(map[string]interface{})
+		store.states[device.Id] = state
+	}
+	state[property] = value
+
+	var document map[string]interface{}
+	if store.format == StateFormatJson {
+		document = store.createDocument(device, state)
+	}
+	store.statesMutex.Unlock()
+
+	store.tracker.StateChanged(device, property, value)
+
+	for _, handler := range store.stateHandlers {
+		handler(device, property, value)
+	}
+
+	if document == nil {
+		store.mqtt.PublishDeviceState(device, property, formatStateValue(value))
+		return
+	}
+
+	encoded, err := json.Marshal(document)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"device.id": device.Id,
+			"error":     err,
+		}).Error("Failed to convert device state to JSON")
+		return
+	}
+
+	store.mqtt.PublishDeviceDocument(device, encoded)
+}
+
+// Get returns the current value of the property, or nil when it isn't known.
+func (store *DeviceStateStore) Get(device *Device, property string) interface{} {
+	store.statesMutex.Lock()
+	defer store.statesMutex.Unlock()
+
+	if state, ok := store.states[device.Id]; ok {
+		return state[property]
+	}
+
+	return nil
+}
+
+// States returns a copy of all known states of the device.
+func (store *DeviceStateStore) States(device *Device) map[string]interface{} {
+	store.statesMutex.Lock()
+	defer store.statesMutex.Unlock()
+
+	states := make(map[string]interface{}, len(store.states[device.Id]))
+	for property, value := range store.states[device.Id] {
+		states[property] = value
+	}
+
+	return states
+}
+
+// Clear removes the (retained) states of the device.
+func (store *DeviceStateStore) Clear(device *Device) {
+	publishMutex := store.publishMutex(device)
+	publishMutex.Lock()
+	defer publishMutex.Unlock()
+
+	store.statesMutex.Lock()
+	delete(store.states, device.Id)
+	delete(store.publishMutexes, device.Id)
+	store.statesMutex.Unlock()
+
+	if store.format == StateFormatJson {
+		store.mqtt.ClearDeviceDocument(device)
+		return
+	}
+
+	for _, property := range store.properties {
+		store.mqtt.ClearDeviceState(device, property)
+	}
+}
+
+// publishMutex returns the mutex which orders publishing the states of the device
+func (store *DeviceStateStore) publishMutex(device *Device) *sync.Mutex {
+	store.statesMutex.Lock()
+	defer store.statesMutex.Unlock()
+
+	mutex, ok := store.publishMutexes[device.Id]
+	if !ok {
+		mutex = &sync.Mutex{}
+		store.publishMutexes[device.Id] = mutex
+	}
+
+	return mutex
+}
+
+// createDocument creates the JSON document of the device, the mutex must be held by the caller
+func (store *DeviceStateStore) createDocument(device *Device, state map[string]interface{}) map[string]interface{} {
+	document := make(map[string]interface{}, len(state)+2)
+	for property, value := range state {
+		document[property] = value
+	}
+
+	document["logical_address"] = int(device.LogicalAddress)
+	if lastSeen := device.LastSeen(); !lastSeen.IsZero() {
+		document["last_seen"] = lastSeen.Format(time.RFC3339)
+	}
+
+	return document
+}
+
+func (store *DeviceStateStore) handleDocument(device *Device, message *MqttMessage) {
+	var values map[string]interface{}
+	if err := json.Unmarshal(message.Payload, &values); err != nil {
+		log.WithFields(log.Fields{
+			"device.id": device.Id,
+			"payload":   string(message.Payload),
+			"error":     err,
+		}).Warn("Received invalid JSON command")
+		return
+	}
+
+	requestId := requestIdFromMessage(message, values)
+	for property, value := range values {
+		if property == "request_id" {
+			continue
+		}
+
+		store.HandleCommand(&DeviceCommand{
+			Device:    device,
+			Property:  property,
+			Value:     value,
+			RequestId: requestId,
+			request:   message,
+			received:  time.Now(),
+		})
+	}
+}
+
+func (store *DeviceStateStore) handleValue(device *Device, property string, message *MqttMessage) {
+	command := &DeviceCommand{
+		Device:   device,
+		Property: property,
+		Value:    string(message.Payload),
+		request:  message,
+		received: time.Now(),
+	}
+
+	// Besides the plain value, a JSON object containing the value and request id is accepted
+	var values map[string]interface{}
+	if json.Unmarshal(message.Payload, &values) == nil {
+		command.Value = values["value"]
+		command.RequestId = requestIdFromMessage(message, values)
+	} else {
+		command.RequestId = requestIdFromMessage(message, nil)
+	}
+
+	store.HandleCommand(command)
+}
+
+// HandleCommand passes the command to the command handler of its property, and
+// returns the error of the handler so callers outside of MQTT can report it.
+func (store *DeviceStateStore) HandleCommand(command *DeviceCommand) error {
+	handler, ok := store.commandHandlers[command.Property]
+	if !ok {
+		log.WithFields(log.Fields{
+			"device.id": command.Device.Id,
+			"property":  command.Property,
+		}).Warn("Received command for unknown property")
+		return fmt.Errorf("Unknown property %s", command.Property)
+	}
+
+	wanted := store.tracker.Wants(command)
+	if wanted {
+		// The command is tracked before it's handled, so the transmission can't be missed
+		store.tracker.Track(command, store.commandOpcodes[command.Property])
+	}
+
+	expected, err := handler(command)
+	if !wanted {
+		return err
+	}
+
+	if err != nil {
+		store.tracker.Cancel(command)
+		store.tracker.Reject(command, err)
+		return err
+	}
+
+	store.tracker.Expect(command, expected, store.Get(command.Device, command.Property))
+	return nil
+}
+
+// requestIdFromMessage returns the request id from the JSON payload or, when using MQTT 5, the correlation data
+func requestIdFromMessage(message *MqttMessage, values map[string]interface{}) string {
+	if requestId, ok := values["request_id"]; ok {
+		return fmt.Sprint(requestId)
+	}
+
+	return string(message.CorrelationData)
+}
+
+// formatStateValue formats the value for its own topic, booleans are published as on and off
+func formatStateValue(value interface{}) interface{} {
+	if enabled, ok := value.(bool); ok {
+		if enabled {
+			return "on"
+		}
+		return "off"
+	}
+
+	return value
+}
+
+// parseOnOff parses a command value which is either on/off or a boolean
+func parseOnOff(value interface{}) (bool, bool) {
+	switch value := value.(type) {
+	case bool:
+		return value, true
+	case string:
+		switch value {
+		case "on", "ON", "true":
+			return true, true
+		case "off", "OFF", "false":
+			return false, true
+		}
+	}
+
+	return false, false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultTopicTemplate is the template used to build the topics of a device. The
+// {property} placeholder must be the last level, as it's replaced by the property
+// and any suffix, like power/set.
+const DefaultTopicTemplate = "{base}/{name}/{property}"
+
+// ValidateTopicTemplate checks whether the topics built by the template are valid
+// and unique for every device.
+func ValidateTopicTemplate(template string) error {
+	if !strings.HasSuffix(template, "/{property}") || strings.Count(template, "{property}") != 1 {
+		return fmt.Errorf("Topic template %s must end with /{property}", template)
+	}
+
+	if !strings.Contains(template, "{name}") && !strings.Contains(template, "{id}") {
+		return fmt.Errorf("Topic template %s must contain {name} or {id}", template)
+	}
+
+	if strings.ContainsAny(template, "+#") {
+		return fmt.Errorf("Topic template %s can't contain wildcards", template)
+	}
+
+	return nil
+}
+
+// ValidateTopicName checks whether the name can be used in the topics of a device
+func ValidateTopicName(name string) error {
+	if name == "" {
+		return errors.New("The topic can't be empty")
+	}
+
+	if strings.ContainsAny(name, "+#") {
+		return fmt.Errorf("The topic %s can't contain wildcards", name)
+	}
+
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("The topic %s can't contain a /", name)
+	}
+
+	// The topics of cec2mqtt itself are published below bridge
+	if name == "bridge" {
+		return fmt.Errorf("The topic %s is reserved", name)
+	}
+
+	return nil
+}
+
+// SlugifyTopic converts a name, like the OSD name of a device, into a name which
+// is safe to use in topics. It only contains lower case letters, digits, - and _.
+func SlugifyTopic(name string) string {
+	slug := strings.Builder{}
+	separator := false
+
+	for _, char := range strings.ToLower(name) {
+		if (char >= 'a' && char <= 'z') || (char >= '0' && char <= '9') || char == '-' {
+			if separator && slug.Len() > 0 {
+				slug.WriteByte('_')
+			}
+			separator = false
+			slug.WriteRune(char)
+		} else {
+			separator = true
+		}
+	}
+
+	if slug.Len() == 0 {
+		return "device"
+	}
+
+	return slug.String()
+}
+
+// DeviceType returns the type of device, based on its logical address
+func DeviceType(address LogicalAddress) string {
+	switch address {
+	case DeviceTV:
+		return "tv"
+	case DeviceRecodingDevice1, DeviceRecodingDevice2, DeviceRecodingDevice3:
+		return "recorder"
+	case DeviceTuner1, DeviceTuner2, DeviceTuner3, DeviceTuner4:
+		return "tuner"
+	case DevicePlaybackDevice1, DevicePlaybackDevice2, DevicePlaybackDevice3:
+		return "playback"
+	case DeviceAudiosystem:
+		return "audio"
+	default:
+		return "other"
+	}
+}
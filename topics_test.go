@@ -0,0 +1,148 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateTopicTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		valid    bool
+	}{
+		{DefaultTopicTemplate, true},
+		{"{base}/{type}/{id}/{property}", true},
+		{"home/{name}/cec/{property}", true},
+		{"{base}/{name}", false},
+		{"{base}/{property}/{name}", false},
+		{"{base}/{property}/{property}", false},
+		{"{base}/{type}/{property}", false},
+		{"{base}/+/{name}/{property}", false},
+		{"{base}/{name}/#/{property}", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.template, func(t *testing.T) {
+			err := ValidateTopicTemplate(test.template)
+			if test.valid && err != nil {
+				t.Errorf("Expected template to be valid, got %v", err)
+			} else if !test.valid && err == nil {
+				t.Error("Expected template to be invalid")
+			}
+		})
+	}
+}
+
+func TestValidateTopicName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"tv", true},
+		{"playstation_4", true},
+		{"Living Room TV", true},
+		{"", false},
+		{"living/tv", false},
+		{"tv+", false},
+		{"tv#", false},
+		{"bridge", false},
+		{"bridge_2", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateTopicName(test.name)
+			if test.valid && err != nil {
+				t.Errorf("Expected name to be valid, got %v", err)
+			} else if !test.valid && err == nil {
+				t.Error("Expected name to be invalid")
+			}
+		})
+	}
+}
+
+func TestSlugifyTopic(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"TV", "tv"},
+		{"PlayStation 4", "playstation_4"},
+		{"Chromecast Ultra", "chromecast_ultra"},
+		{"living/room#tv", "living_room_tv"},
+		{"  Apple  TV  ", "apple_tv"},
+		{"AV-receiver", "av-receiver"},
+		{"Téléviseur", "t_l_viseur"},
+		{"", "device"},
+		{"+#/", "device"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if slug := SlugifyTopic(test.name); slug != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, slug)
+			}
+
+			if err := ValidateTopicName(SlugifyTopic(test.name)); err != nil {
+				t.Errorf("Expected slug to be a valid topic, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDeviceType(t *testing.T) {
+	tests := []struct {
+		address  LogicalAddress
+		expected string
+	}{
+		{DeviceTV, "tv"},
+		{DeviceRecodingDevice2, "recorder"},
+		{DeviceTuner4, "tuner"},
+		{DevicePlaybackDevice1, "playback"},
+		{DeviceAudiosystem, "audio"},
+		{DeviceFreeUse, "other"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.address.String(), func(t *testing.T) {
+			if deviceType := DeviceType(test.address); deviceType != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, deviceType)
+			}
+		})
+	}
+}
+
+func TestMigrateTopics(t *testing.T) {
+	registry := &DeviceRegistry{
+		configDevices: map[string]*DeviceConfig{
+			"a": {Id: "a", OSD: "TV", MqttTopic: "tv"},
+			"b": {Id: "b", OSD: "TV", MqttTopic: "tv"},
+			"c": {Id: "c", OSD: "Chromecast", MqttTopic: "living/chromecast"},
+			"d": {Id: "d", OSD: "PlayStation 4", MqttTopic: ""},
+			"e": {Id: "e", OSD: "Shield", MqttTopic: "shield"},
+			"f": {Id: "f", OSD: "Bridge", MqttTopic: "bridge"},
+		},
+	}
+
+	if !registry.migrateTopics() {
+		t.Fatal("Expected topics to be migrated")
+	}
+
+	expected := map[string]string{
+		"a": "tv_2",
+		"b": "tv",
+		"c": "living_chromecast",
+		"d": "playstation_4",
+		"e": "shield",
+		"f": "bridge_2",
+	}
+
+	for id, topic := range expected {
+		if actual := registry.configDevices[id].MqttTopic; actual != topic {
+			t.Errorf("Expected device %s to get topic %s, got %s", id, topic, actual)
+		}
+	}
+
+	if registry.migrateTopics() {
+		t.Error("Expected migrated topics to be valid")
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TrafficIncoming = "in"
+	TrafficOutgoing = "out"
+)
+
+// TrafficRecord is a single frame in a traffic file, stored as one JSON object per line.
+type TrafficRecord struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Frame     string    `json:"frame"`
+	Opcode    string    `json:"opcode,omitempty"`
+	Level     LogLevel  `json:"level,omitempty"`
+	Message   Message   `json:"-"`
+}
+
+// TrafficCapture writes all traffic to a file, which is rotated when it
+// reaches its maximum size.
+type TrafficCapture struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+// Matches the traffic lines in the output of cec-client, like "TRAFFIC: [   395]	>> 0f:87:00:e0:91"
+var cecClientTrafficLine = regexp.MustCompile(`^TRAFFIC:\s*\[\s*(\d+)\]\s+(>>|<<) ([0-9a-fA-F:]+)`)
+
+// ReadTrafficFile reads a traffic file, which either contains JSON lines or
+// the traffic log as written by cec-client.
+func ReadTrafficFile(path string) ([]*TrafficRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := make([]*TrafficRecord, 0)
+	start := time.Now()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		record := &TrafficRecord{}
+		if strings.HasPrefix(line, "{") {
+			if err := json.Unmarshal([]byte(line), record); err != nil {
+				return nil, fmt.Errorf("Line %d of %s is not a valid traffic record: %w", lineNumber, path, err)
+			}
+		} else if matches := cecClientTrafficLine.FindStringSubmatch(line); matches != nil {
+			milliseconds, _ := strconv.Atoi(matches[1])
+			record.Time = start.Add(time.Duration(milliseconds) * time.Millisecond)
+			record.Direction = TrafficIncoming
+			if matches[2] == "<<" {
+				record.Direction = TrafficOutgoing
+			}
+			record.Frame = matches[3]
+		} else {
+			continue
+		}
+
+		if record.Direction != TrafficIncoming && record.Direction != TrafficOutgoing {
+			return nil, fmt.Errorf("Line %d of %s has an invalid direction %q", lineNumber, path, record.Direction)
+		}
+
+		message, err := ParseMessage(record.Frame)
+		if err != nil || len(message) == 0 {
+			return nil, fmt.Errorf("Line %d of %s contains an invalid frame %q", lineNumber, path, record.Frame)
+		}
+		record.Message = message
+
+		records = append(records, record)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// LogLine returns the line libcec would log for the frame.
+func (record *TrafficRecord) LogLine() string {
+	if record.Direction == TrafficOutgoing {
+		return "<< " + formatFrame(record.Message)
+	}
+
+	return ">> " + formatFrame(record.Message)
+}
+
+func NewTrafficRecord(logMessage *LogMessage) *TrafficRecord {
+	if len(logMessage.Message) < 3 {
+		return nil
+	}
+
+	var direction string
+	switch logMessage.Message[:3] {
+	case ">> ":
+		direction = TrafficIncoming
+	case "<< ":
+		direction = TrafficOutgoing
+	default:
+		return nil
+	}
+
+	message, err := ParseMessage(logMessage.Message[3:])
+	if err != nil || len(message) == 0 {
+		return nil
+	}
+
+	record := &TrafficRecord{
+		Time:      time.Now(),
+		Direction: direction,
+		Frame:     formatFrame(message),
+		Level:     logMessage.Level,
+		Message:   message,
+	}
+
+	if len(message) > 1 {
+		record.Opcode = message.Opcode().String()
+	}
+
+	return record
+}
+
+func OpenTrafficCapture(path string, maxSize int64, maxFiles int) (*TrafficCapture, error) {
+	capture := &TrafficCapture{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	if err := capture.open(); err != nil {
+		return nil, err
+	}
+
+	return capture, nil
+}
+
+func (capture *TrafficCapture) open() error {
+	file, err := os.OpenFile(capture.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	capture.file = file
+	capture.size = info.Size()
+
+	return nil
+}
+
+func (capture *TrafficCapture) Write(record *TrafficRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to convert traffic record to JSON")
+		return
+	}
+	data = append(data, '\n')
+
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+
+	if capture.file == nil {
+		return
+	}
+
+	if capture.size > 0 && capture.size+int64(len(data)) > capture.maxSize {
+		if err := capture.rotate(); err != nil {
+			log.WithFields(log.Fields{
+				"error":        err,
+				"capture_file": capture.path,
+			}).Error("Failed to rotate capture file, stopping capture")
+			return
+		}
+	}
+
+	written, err := capture.file.Write(data)
+	capture.size += int64(written)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":        err,
+			"capture_file": capture.path,
+		}).Error("Failed to write to capture file")
+	}
+}
+
+// rotate moves the current file to <path>.1, shifting existing rotated files
+// up and removing the ones exceeding the maximum number of files.
+func (capture *TrafficCapture) rotate() error {
+	capture.file.Close()
+	capture.file = nil
+
+	for i := capture.maxFiles - 1; i > 0; i-- {
+		from := capture.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", capture.path, i-1)
+		}
+
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", capture.path, i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if capture.maxFiles <= 1 {
+		if err := os.Remove(capture.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return capture.open()
+}
+
+func (capture *TrafficCapture) Close() {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+
+	if capture.file != nil {
+		capture.file.Close()
+		capture.file = nil
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterInitializer(0, InitWatchdog)
+}
+
+type Watchdog struct {
+	cec    *Cec
+	mqtt   *Mqtt
+	config *WatchdogConfig
+
+	healthy     bool
+	healthMutex sync.Mutex
+	probed      bool
+	restart     chan string
+}
+
+func InitWatchdog(container *Container) {
+	cec := container.Get("cec").(*Cec)
+	mqtt := container.Get("mqtt").(*Mqtt)
+	config := container.Get("config").(*Config)
+
+	if config.Cec.Backend == "replay" {
+		log.Info("Not starting CEC watchdog as traffic is being replayed")
+		return
+	}
+
+	watchdog := &Watchdog{
+		cec:     cec,
+		mqtt:    mqtt,
+		config:  &config.Cec.Watchdog,
+		healthy: true,
+		restart: make(chan string, 1),
+	}
+
+	mqtt.RegisterConnectedHandler(watchdog.publishHealth)
+
+	go watchdog.run()
+
+	container.Register("watchdog", watchdog)
+}
+
+func (watchdog *Watchdog) run() {
+	// MQTT is connected before the initializers run, so the connected handler only covers reconnects
+	watchdog.publishHealth()
+
+	ticker := time.NewTicker(watchdog.config.CheckInterval)
+
+	for {
+		select {
+		case reason := <-watchdog.restart:
+			watchdog.reconnect(reason)
+		case <-ticker.C:
+			if reason := watchdog.check(); reason != "" {
+				watchdog.reconnect(reason)
+			}
+		}
+	}
+}
+
+// Reconnect makes the watchdog reconnect right away, instead of waiting for the next check
+func (watchdog *Watchdog) Reconnect(reason string) {
+	select {
+	case watchdog.restart <- reason:
+	default:
+		// A reconnect is already pending
+	}
+}
+
+func (watchdog *Watchdog) check() string {
+	if !watchdog.cec.AdapterPresent() {
+		return "adapter disappeared"
+	}
+
+	if errors := watchdog.cec.ConsecutiveErrors(); errors >= watchdog.config.MaxErrors {
+		return "too many errors"
+	}
+
+	idle := time.Since(watchdog.cec.LastReceived())
+	if idle < watchdog.config.IdleTimeout {
+		watchdog.probed = false
+		return ""
+	}
+
+	if watchdog.probed {
+		return "no traffic received"
+	}
+
+	log.WithFields(log.Fields{
+		"idle": idle,
+	}).Debug("No CEC traffic received for a while, probing connection")
+
+	watchdog.probed = true
+	// The probe is done asynchronously as it would block the watchdog when libcec hangs
+	go watchdog.cec.Probe()
+
+	return ""
+}
+
+func (watchdog *Watchdog) reconnect(reason string) {
+	log.WithFields(log.Fields{
+		"reason": reason,
+	}).Warn("CEC connection seems to be lost, reconnecting")
+
+	watchdog.setHealthy(false)
+
+	backoff := time.Second
+	for {
+		err := watchdog.cec.Restart()
+		if err == nil {
+			break
+		}
+
+		log.WithFields(log.Fields{
+			"error":   err,
+			"backoff": backoff,
+		}).Error("Failed to restart CEC connection")
+
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > watchdog.config.MaxBackoff {
+			backoff = watchdog.config.MaxBackoff
+		}
+	}
+
+	watchdog.probed = false
+	watchdog.setHealthy(true)
+
+	log.Info("CEC connection has been restored")
+}
+
+func (watchdog *Watchdog) setHealthy(healthy bool) {
+	watchdog.healthMutex.Lock()
+	watchdog.healthy = healthy
+	watchdog.healthMutex.Unlock()
+
+	watchdog.publishHealth()
+}
+
+func (watchdog *Watchdog) publishHealth() {
+	watchdog.healthMutex.Lock()
+	defer watchdog.healthMutex.Unlock()
+
+	value := "offline"
+	if watchdog.healthy {
+		value = "online"
+	}
+
+	watchdog.mqtt.Publish(watchdog.mqtt.BuildBridgeTopic("health"), 0, true, value)
+}